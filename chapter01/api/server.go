@@ -0,0 +1,326 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"redis-practice/chapter01"
+	"redis-practice/chapter01/service"
+	"redis-practice/common"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Server 以 JSON 接口暴露文章服务
+//
+//	POST /articles                               发布文章 {"author", "title", "link"}
+//	GET  /articles?page=&order=                  分页获取文章
+//	GET  /articles/{id}                          获取单篇文章
+//	POST /articles/{id}/vote                     投票 {"user", "direction": "up" | "down"}
+//	POST /articles/{id}/groups                   调整分组 {"add": [], "remove": []}
+//	GET  /groups/{group}/articles?page=&order=   分页获取分组内的文章
+//	GET  /moderation/articles                    获取有待审核投票的文章
+//	GET  /moderation/articles/{id}/votes         获取文章待审核的投票
+//	POST /moderation/articles/{id}/votes/{user}  审核投票 {"accept": true | false}
+//
+// 投票时以客户端 IP 和 X-Device-Fingerprint 请求头识别刷票，被隔离的投票返回 202
+type Server struct {
+	svc *service.ArticleService
+	mux *http.ServeMux
+}
+
+func NewServer(svc *service.ArticleService) *Server {
+	s := &Server{svc: svc, mux: http.NewServeMux()}
+	s.mux.HandleFunc("/articles", s.handleArticles)
+	s.mux.HandleFunc("/articles/", s.handleArticle)
+	s.mux.HandleFunc("/groups/", s.handleGroup)
+	s.mux.HandleFunc("/moderation/articles", s.handleFlagged)
+	s.mux.HandleFunc("/moderation/articles/", s.handleReview)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+type postArticleRequest struct {
+	Author string `json:"author"`
+	Title  string `json:"title"`
+	Link   string `json:"link"`
+}
+
+type voteRequest struct {
+	User      string `json:"user"`
+	Direction string `json:"direction"`
+}
+
+type reviewRequest struct {
+	Accept bool `json:"accept"`
+}
+
+type groupsRequest struct {
+	Add    []string `json:"add"`
+	Remove []string `json:"remove"`
+}
+
+var errBadRequest = errors.New("malformed request")
+
+// handleArticles 处理 /articles
+func (s *Server) handleArticles(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		page, order := pageAndOrder(r)
+		articles, err := s.svc.GetArticles(r.Context(), page, order)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, articles)
+
+	case http.MethodPost:
+		var req postArticleRequest
+		if err := decode(r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
+		articleID, err := s.svc.PostArticle(r.Context(), req.Author, req.Title, req.Link)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]string{"id": articleID})
+
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+// handleArticle 处理 /articles/{id} 及其子资源
+func (s *Server) handleArticle(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/articles/"), "/"), "/")
+	articleID := parts[0]
+
+	switch {
+	case len(parts) == 1:
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		article, err := s.svc.GetArticle(r.Context(), articleID)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, article)
+
+	case len(parts) == 2 && parts[1] == "vote":
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+		var req voteRequest
+		if err := decode(r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
+		source := voteSource(r)
+		var err error
+		switch req.Direction {
+		case "", "up":
+			err = s.svc.VoteArticle(r.Context(), articleID, req.User, source)
+		case "down":
+			err = s.svc.DownVoteArticle(r.Context(), articleID, req.User, source)
+		default:
+			err = errBadRequest
+		}
+		if errors.Is(err, service.ErrVoteQuarantined) {
+			writeJSON(w, http.StatusAccepted, map[string]string{"status": "quarantined"})
+			return
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case len(parts) == 2 && parts[1] == "groups":
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+		var req groupsRequest
+		if err := decode(r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
+		if err := s.svc.AddRemoveGroups(r.Context(), articleID, req.Add, req.Remove); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleGroup 处理 /groups/{group}/articles
+func (s *Server) handleGroup(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/groups/"), "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "articles" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	page, order := pageAndOrder(r)
+	articles, err := s.svc.GetGroupArticles(r.Context(), parts[0], order, page)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, articles)
+}
+
+// handleFlagged 处理 /moderation/articles
+func (s *Server) handleFlagged(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	articles, err := s.svc.GetFlaggedArticles(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, articles)
+}
+
+// handleReview 处理 /moderation/articles/{id}/votes 及 /moderation/articles/{id}/votes/{user}
+func (s *Server) handleReview(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/moderation/articles/"), "/"), "/")
+	if len(parts) < 2 || parts[1] != "votes" {
+		http.NotFound(w, r)
+		return
+	}
+	articleID := parts[0]
+
+	switch len(parts) {
+	case 2:
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		votes, err := s.svc.GetQuarantinedVotes(r.Context(), articleID)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, votes)
+
+	case 3:
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+		var req reviewRequest
+		if err := decode(r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
+		if err := s.svc.ReviewVote(r.Context(), articleID, parts[2], req.Accept); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// voteSource 从请求中提取投票来源
+func voteSource(r *http.Request) chapter01.VoteSource {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return chapter01.VoteSource{
+		IP:          ip,
+		Fingerprint: r.Header.Get("X-Device-Fingerprint"),
+	}
+}
+
+// pageAndOrder 解析分页和排序参数，page 默认为 1
+func pageAndOrder(r *http.Request) (int64, string) {
+	query := r.URL.Query()
+	page, err := strconv.ParseInt(query.Get("page"), 10, 64)
+	if err != nil || page < 1 {
+		page = 1
+	}
+	return page, query.Get("order")
+}
+
+func decode(r *http.Request, v any) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return errBadRequest
+	}
+	return nil
+}
+
+// statusCode 将服务层错误映射为 HTTP 状态码
+func statusCode(err error) int {
+	switch {
+	case errors.Is(err, errBadRequest),
+		errors.Is(err, service.ErrEmptyAuthor),
+		errors.Is(err, service.ErrInvalidTitle),
+		errors.Is(err, service.ErrInvalidLink),
+		errors.Is(err, service.ErrInvalidArticleID):
+		return http.StatusBadRequest
+	case errors.Is(err, service.ErrArticleNotFound),
+		errors.Is(err, service.ErrVoteNotQuarantined):
+		return http.StatusNotFound
+	case errors.Is(err, service.ErrVotingClosed):
+		return http.StatusConflict
+	case errors.Is(err, service.ErrRateLimited):
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	var limited *common.RateLimitError
+	if errors.As(err, &limited) {
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(limited.RetryAfter.Seconds())), 10))
+	}
+
+	code := statusCode(err)
+	msg := err.Error()
+	if code == http.StatusInternalServerError {
+		logrus.Error("article api failed, err: ", err)
+		msg = http.StatusText(code)
+	}
+	writeJSON(w, code, map[string]string{"error": msg})
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": http.StatusText(http.StatusMethodNotAllowed)})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.Error("write json response failed, err: ", err)
+	}
+}
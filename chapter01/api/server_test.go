@@ -0,0 +1,41 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"redis-practice/chapter01/service"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerRejectsInvalidRequests(t *testing.T) {
+	server := NewServer(service.NewArticleService(nil))
+
+	cases := []struct {
+		method, path, body string
+		code               int
+	}{
+		{http.MethodPost, "/articles", `{"author":"hualulu","title":"t","link":"not a url"}`, http.StatusBadRequest},
+		{http.MethodPost, "/articles", `{`, http.StatusBadRequest},
+		{http.MethodDelete, "/articles", ``, http.StatusMethodNotAllowed},
+		{http.MethodGet, "/articles/article:1", ``, http.StatusBadRequest},
+		{http.MethodPost, "/articles/1/vote", `{"user":"lurenjia","direction":"sideways"}`, http.StatusBadRequest},
+		{http.MethodGet, "/articles/1/unknown", ``, http.StatusNotFound},
+		{http.MethodGet, "/groups/redis", ``, http.StatusNotFound},
+	}
+
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, httptest.NewRequest(c.method, c.path, strings.NewReader(c.body)))
+		assert.Equal(t, c.code, rec.Code, "%s %s", c.method, c.path)
+	}
+}
+
+func TestStatusCode(t *testing.T) {
+	assert.Equal(t, http.StatusNotFound, statusCode(service.ErrArticleNotFound))
+	assert.Equal(t, http.StatusConflict, statusCode(service.ErrVotingClosed))
+	assert.Equal(t, http.StatusBadRequest, statusCode(service.ErrInvalidLink))
+}
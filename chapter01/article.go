@@ -2,7 +2,9 @@ package chapter01
 
 import (
 	"context"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"redis-practice/common"
@@ -12,109 +14,285 @@ import (
 )
 
 type Article interface {
-	PostArticle(context.Context, string, string, string) string
-	ArticleUpVote(context.Context, string, string)
-	ArticleDownVote(context.Context, string, string)
+	PostArticle(context.Context, string, string, string) (string, error)
+	ArticleUpVote(context.Context, string, string) error
+	ArticleDownVote(context.Context, string, string) error
+	ArticleVoteFrom(context.Context, string, string, bool, VoteSource) error
+	GetArticle(context.Context, string) (map[string]string, error)
 	GetArticles(context.Context, int64, string) []map[string]string
 	AddRemoveGroups(context.Context, string, []string, []string)
 	GetGroupArticle(context.Context, string, string, int64) []map[string]string
-	Reset()
+	Reset(context.Context)
 }
 
+var _ Article = ArticleRepo{}
+
 type ArticleRepo struct {
 	client *common.Client
+	// PageSize 每页文章数，为 0 时使用 common.ArticlesPerPage
+	PageSize int64
+	// Rankers 文章排名策略，为 nil 时使用 DefaultRankers
+	Rankers []Ranker
+	// PostLimiter 按作者限制发文频率，为 nil 时不限流
+	PostLimiter common.RateLimiter
+	// VoteLimiter 按用户限制投票频率，为 nil 时不限流
+	VoteLimiter common.RateLimiter
 }
 
+// NewArticleRepo 创建 ArticleRepo，默认每个作者每小时最多发 10 篇文章，
+// 每个用户每秒补充 1 次、最多连续 30 次投票
 func NewArticleRepo(conn *common.Client) *ArticleRepo {
-	return &ArticleRepo{conn}
+	return &ArticleRepo{
+		client:      conn,
+		PostLimiter: common.NewSlidingWindowLimiter(conn, 10, time.Hour),
+		VoteLimiter: common.NewTokenBucketLimiter(conn, 1, 30),
+	}
 }
 
 // PostArticle post article，return new article id
-func (r ArticleRepo) PostArticle(ctx context.Context, author string, title string, link string) string {
-	articleID := strconv.Itoa(int(r.client.Incr(ctx, common.ArticleID).Val()))
+func (r ArticleRepo) PostArticle(ctx context.Context, author string, title string, link string) (string, error) {
+	if err := common.CheckRateLimit(ctx, r.PostLimiter, "post:"+author); err != nil {
+		return "", err
+	}
 
-	// voted set of the article
-	votedSetKey := common.VotedSetPre + articleID
-	r.client.SAdd(ctx, votedSetKey, author)
-	r.client.Expire(ctx, votedSetKey, common.OneWeekInSeconds*time.Second)
+	articleID := strconv.Itoa(int(r.client.Incr(ctx, common.ArticleID).Val()))
 
 	now := time.Now().Unix()
 
+	// voted sets of the article, the author can't vote for their own article
+	deadline := time.Unix(now+common.OneWeekInSeconds, 0)
+	for _, votedSetKey := range []string{common.VotedSetPre + articleID, common.DownVotedSetPre + articleID} {
+		r.client.SAdd(ctx, votedSetKey, author)
+		r.client.ExpireAt(ctx, votedSetKey, deadline)
+	}
+
 	// attributes hash set of article
 	r.client.HSet(ctx, common.ArticleHashSetPre+articleID, map[string]any{
-		"id":     articleID,
-		"title":  title,
-		"link":   link,
-		"poster": author,
-		"time":   now,
-		"votes":  0,
+		"id":        articleID,
+		"title":     title,
+		"link":      link,
+		"poster":    author,
+		"time":      now,
+		"votes":     0,
+		"upvotes":   0,
+		"downvotes": 0,
+		"comments":  0,
 	})
 
-	// score sorted set
-	r.client.ZAdd(ctx, common.Score, redis.Z{
-		Score:  float64(now),
-		Member: articleID,
-	})
-	// time sorted set
-	r.client.ZAdd(ctx, common.Time, redis.Z{
-		Score:  float64(now),
-		Member: articleID,
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		// time sorted set
+		pipe.ZAdd(ctx, common.Time, redis.Z{
+			Score:  float64(now),
+			Member: articleID,
+		})
+		// ranking sorted sets, score etc.
+		r.addRanks(ctx, pipe, articleID, VoteStats{Posted: now}, now)
+		addEvent(ctx, pipe, EventPosted, articleID, author)
+		return nil
 	})
+	if err != nil {
+		logrus.Error("add article ranks failed, err: ", err)
+	}
 
-	return articleID
+	return articleID, nil
 }
 
-func (r ArticleRepo) ArticleUpVote(ctx context.Context, articleID, user string) {
-	// voting deadline
-	cutoff := r.client.ZScore(ctx, common.Time, articleID).Val() + common.OneWeekInSeconds
-	if time.Now().Unix() > int64(cutoff) {
-		logrus.Info("Voting has closed...")
-		return
-	}
+// voteScript 原子地完成投票：检查截止时间，加入本方投票集合，
+// 若用户之前投过相反的票则将其从对方集合移除，并同时修正票数统计。
+// 返回 -2 表示不存在，-1 表示投票已截止，0 表示已投过，1 表示新投一票，2 表示改投了相反的票
+//
+// KEYS: time, 本方投票集合, 对方投票集合, 文章哈希
+// ARGV: 文章 id, 用户, 当前时间, 投票方向(1/-1), 投票窗口秒数
+var voteScript = redis.NewScript(`
+local posted = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if not posted then
+	return -2
+end
+if tonumber(ARGV[3]) > tonumber(posted) + tonumber(ARGV[5]) then
+	return -1
+end
+if redis.call('SADD', KEYS[2], ARGV[2]) == 0 then
+	return 0
+end
+local direction = tonumber(ARGV[4])
+local delta = direction
+local field, other = 'upvotes', 'downvotes'
+if direction < 0 then
+	field, other = other, field
+end
+redis.call('HINCRBY', KEYS[4], field, 1)
+if redis.call('SREM', KEYS[3], ARGV[2]) == 1 then
+	redis.call('HINCRBY', KEYS[4], other, -1)
+	delta = delta * 2
+end
+redis.call('HINCRBY', KEYS[4], 'votes', delta)
+return delta * direction
+`)
 
-	if r.client.SAdd(ctx, common.VotedSetPre+articleID, user).Val() != 0 {
-		r.client.ZIncrBy(ctx, common.Score, common.VotedScore, articleID)
-		r.client.HIncrBy(ctx, common.ArticleHashSetPre+articleID, "votes", 1)
+// ArticleUpVote 投赞成票，已投反对票的用户会改为赞成票
+func (r ArticleRepo) ArticleUpVote(ctx context.Context, articleID, user string) error {
+	return r.ArticleVoteFrom(ctx, articleID, user, true, VoteSource{})
+}
+
+// ArticleDownVote 投反对票，已投赞成票的用户会改为反对票
+func (r ArticleRepo) ArticleDownVote(ctx context.Context, articleID, user string) error {
+	return r.ArticleVoteFrom(ctx, articleID, user, false, VoteSource{})
+}
+
+// applyVote 执行投票并更新排名、排行榜和事件，不做限流和反作弊检查。
+// 排名由 Ranker 在 Go 中计算，无法与投票脚本原子完成，投票计入后更新排名失败只记录日志，
+// 排名由下一次 RefreshRanks 修正，避免调用方重试已计入的投票
+func (r ArticleRepo) applyVote(ctx context.Context, articleID, user string, up bool) error {
+	res, err := r.runVote(ctx, common.Time, common.VotedSetPre+articleID, common.DownVotedSetPre+articleID,
+		common.ArticleHashSetPre+articleID, articleID, user, up)
+	if err != nil {
+		return err
 	}
 
+	switch res {
+	case -2:
+		return ErrArticleNotFound
+	case -1:
+		return ErrVotingClosed
+	case 1, 2:
+		eventType, delta := EventUpVoted, int64(res)
+		if !up {
+			eventType, delta = EventDownVoted, -delta
+		}
+		r.recordLeaderboardVote(ctx, articleID, delta)
+		r.recordUserVote(ctx, articleID, user, up)
+		r.publishEvent(ctx, eventType, articleID, user)
+		if err := r.updateRanks(ctx, articleID); err != nil {
+			logrus.Errorf("update article %s ranks failed, err: %v", articleID, err)
+		}
+	}
+	return nil
 }
 
-func (r ArticleRepo) ArticleDownVote(ctx context.Context, articleID, user string) {
-	// voting deadline
-	cutoff := r.client.ZScore(ctx, common.Time, articleID).Val() + common.OneWeekInSeconds
-	if time.Now().Unix() > int64(cutoff) {
-		logrus.Info("Voting has closed...")
-		return
+// runVote 执行投票脚本，timeKey 为记录发布时间的有序集合，返回值含义见 voteScript
+func (r ArticleRepo) runVote(ctx context.Context, timeKey, votedSetKey, downVotedSetKey, hashKey, id, user string, up bool) (int, error) {
+	otherSetKey, direction := downVotedSetKey, 1
+	if !up {
+		votedSetKey, otherSetKey, direction = downVotedSetKey, votedSetKey, -1
 	}
 
-	if r.client.SAdd(ctx, common.VotedSetPre+articleID, user).Val() != 0 {
-		r.client.ZIncrBy(ctx, common.Score, -common.VotedScore, articleID)
-		r.client.HIncrBy(ctx, common.ArticleHashSetPre+articleID, "votes", -1)
+	return voteScript.Run(ctx, r.client,
+		[]string{timeKey, votedSetKey, otherSetKey, hashKey},
+		id, user, time.Now().Unix(), direction, common.OneWeekInSeconds,
+	).Int()
+}
+
+// GetArticle 获取单篇文章，groups 字段为逗号分隔的所属分组
+func (r ArticleRepo) GetArticle(ctx context.Context, articleID string) (map[string]string, error) {
+	articles := r.getArticlesByIDs(ctx, []string{articleID})
+	if len(articles) == 0 {
+		return nil, ErrArticleNotFound
 	}
+	return articles[0], nil
+}
+
+// GetArticles 按 time 或排名名称（score、hot、votes、best 等）排序分页获取文章，page 从 1 开始
+func (r ArticleRepo) GetArticles(ctx context.Context, page int64, order string) []map[string]string {
+	return r.getArticlesByKey(ctx, r.orderKey(order), page)
 }
 
-func (r ArticleRepo) GetArticles(ctx context.Context) ([]map[string]string, error) {
-	members, err := r.client.ZRevRange(ctx, common.Score, 0, -1).Result()
+// AddRemoveGroups 将文章加入 toAdd 中的分组，并从 toRemove 中的分组移除
+func (r ArticleRepo) AddRemoveGroups(ctx context.Context, articleID string, toAdd, toRemove []string) {
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, group := range toAdd {
+			pipe.SAdd(ctx, common.GroupPre+group, articleID)
+			pipe.SAdd(ctx, common.ArticleGroupsPre+articleID, group)
+		}
+		for _, group := range toRemove {
+			pipe.SRem(ctx, common.GroupPre+group, articleID)
+			pipe.SRem(ctx, common.ArticleGroupsPre+articleID, group)
+		}
+		return nil
+	})
 	if err != nil {
-		return nil, err
+		logrus.Error("add remove groups failed, err: ", err)
+	}
+}
+
+// GetGroupArticle 按 time 或排名名称排序分页获取分组内的文章
+func (r ArticleRepo) GetGroupArticle(ctx context.Context, group, order string, page int64) []map[string]string {
+	order = r.orderKey(order)
+	// 分组集合与排序有序集合的交集，如 score:programming
+	key := order + ":" + group
+	// 缓存不存在时才重新计算交集，并设置较短的过期时间
+	if r.client.Exists(ctx, key).Val() == 0 {
+		_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			// 分组集合成员的分值为 1，权重为 0 使结果保留排序有序集合的原始分值
+			pipe.ZInterStore(ctx, key, &redis.ZStore{
+				Keys:    []string{common.GroupPre + group, order},
+				Weights: []float64{0, 1},
+			})
+			pipe.Expire(ctx, key, common.GroupCacheSeconds*time.Second)
+			return nil
+		})
+		if err != nil {
+			logrus.Error("zinterstore group articles failed, err: ", err)
+			return nil
+		}
+	}
+
+	return r.getArticlesByKey(ctx, key, page)
+}
+
+// getArticlesByKey 按有序集合 key 中的排名从高到低分页获取文章，page 从 1 开始
+func (r ArticleRepo) getArticlesByKey(ctx context.Context, key string, page int64) []map[string]string {
+	if page < 1 {
+		page = 1
 	}
+	size := r.pageSize()
+	start := (page - 1) * size
+	end := start + size - 1
 
-	articles := make([]map[string]string, 0, len(members))
-	for _, articleID := range members {
-		articles = append(articles, r.client.HGetAll(ctx, common.ArticleHashSetPre+articleID).Val())
+	ids, err := r.client.ZRevRange(ctx, key, start, end).Result()
+	if err != nil || len(ids) == 0 {
+		return []map[string]string{}
 	}
 
-	return articles, nil
+	return r.getArticlesByIDs(ctx, ids)
 }
 
-func (r ArticleRepo) AddRemoveGroups(s string, strings []string, strings2 []string) {
-	//TODO implement me
-	panic("implement me")
+// getArticlesByIDs 流水线批量获取文章哈希及所属分组，避免每篇文章一次往返
+func (r ArticleRepo) getArticlesByIDs(ctx context.Context, ids []string) []map[string]string {
+	hashCmds := make([]*redis.MapStringStringCmd, 0, len(ids))
+	groupCmds := make([]*redis.StringSliceCmd, 0, len(ids))
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, articleID := range ids {
+			hashCmds = append(hashCmds, pipe.HGetAll(ctx, common.ArticleHashSetPre+articleID))
+			groupCmds = append(groupCmds, pipe.SMembers(ctx, common.ArticleGroupsPre+articleID))
+		}
+		return nil
+	})
+	if err != nil {
+		logrus.Error("get articles pipeline failed, err: ", err)
+		return []map[string]string{}
+	}
+
+	articles := make([]map[string]string, 0, len(hashCmds))
+	for i, cmd := range hashCmds {
+		// 跳过已被删除但仍残留在有序集合中的文章
+		article := cmd.Val()
+		if len(article) == 0 {
+			continue
+		}
+		groups := groupCmds[i].Val()
+		sort.Strings(groups)
+		article["groups"] = strings.Join(groups, ",")
+		articles = append(articles, article)
+	}
+
+	return articles
 }
 
-func (r ArticleRepo) GetGroupArticle(s string, s2 string, i int64) []map[string]string {
-	//TODO implement me
-	panic("implement me")
+func (r ArticleRepo) pageSize() int64 {
+	if r.PageSize > 0 {
+		return r.PageSize
+	}
+	return common.ArticlesPerPage
 }
 
 func (r ArticleRepo) Reset(ctx context.Context) {
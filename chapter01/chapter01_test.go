@@ -1,13 +1,17 @@
 package chapter01
 
 import (
+	"bytes"
 	"context"
 	"os"
+	"strconv"
 	"testing"
+	"time"
 
 	"redis-practice"
 	"redis-practice/common"
 
+	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -24,35 +28,391 @@ func TestMain(m *testing.M) {
 		DB:       redis_practice.DB,
 	})
 
-	defer conn.Close()
-
-	client = common.NewClient(conn)
-	articleRepo = &ArticleRepo{client: client}
+	if conn != nil {
+		defer conn.Close()
+		client = common.NewClient(conn)
+		articleRepo = &ArticleRepo{client: client}
+	}
 
 	code := m.Run()
 
 	os.Exit(code)
 }
 
+// skipWithoutRedis redis 不可用时跳过测试
+func skipWithoutRedis(t *testing.T) {
+	if client == nil {
+		t.Skip("redis is not available")
+	}
+}
+
 func TestChapter01(t *testing.T) {
-	articleID := articleRepo.PostArticle(ctx, "hualulu", "hualubang up up", "http://www.hualubang.com/1")
+	skipWithoutRedis(t)
+	articleID, _ := articleRepo.PostArticle(ctx, "hualulu", "hualubang up up", "http://www.hualubang.com/1")
 	t.Log("posted a new article with id :", articleID)
 	assert.Equal(t, "1", articleID, "should be `1`")
 
-	articleID = articleRepo.PostArticle(ctx, "guadandan", "i love hualubang", "http://www.hualubang.com/2")
+	articleID, _ = articleRepo.PostArticle(ctx, "guadandan", "i love hualubang", "http://www.hualubang.com/2")
 	t.Log("posted a new article with id :", articleID)
 	assert.Equal(t, "2", articleID, "should be `2`")
 
-	articles, _ := articleRepo.GetArticles(ctx)
+	articles := articleRepo.GetArticles(ctx, 1, common.Score)
 	assert.EqualValues(t, 2, len(articles), "articles number should be 2")
 
 	articleRepo.ArticleUpVote(ctx, "1", "lurenjia")
 	articleRepo.ArticleUpVote(ctx, "1", "lurenyi")
 
-	articles, _ = articleRepo.GetArticles(ctx)
+	articles = articleRepo.GetArticles(ctx, 1, common.Score)
 	t.Log(articles)
 
 	assert.Equal(t, "2", articles[0]["votes"], "votes should be 2 of `hualubang up up`")
 
 	defer articleRepo.Reset(ctx)
 }
+
+func TestArticleGroups(t *testing.T) {
+	skipWithoutRedis(t)
+	defer articleRepo.Reset(ctx)
+
+	first, _ := articleRepo.PostArticle(ctx, "hualulu", "redis in action", "http://www.hualubang.com/3")
+	second, _ := articleRepo.PostArticle(ctx, "guadandan", "go in action", "http://www.hualubang.com/4")
+
+	articleRepo.AddRemoveGroups(ctx, first, []string{"redis", "programming"}, nil)
+	articleRepo.AddRemoveGroups(ctx, second, []string{"programming"}, nil)
+	articleRepo.ArticleUpVote(ctx, second, "lurenjia")
+
+	articles := articleRepo.GetGroupArticle(ctx, "programming", common.Score, 1)
+	assert.EqualValues(t, 2, len(articles), "programming group should have 2 articles")
+	assert.Equal(t, second, articles[0]["id"], "voted article should rank first")
+
+	articles = articleRepo.GetGroupArticle(ctx, "programming", common.Votes, 1)
+	assert.Equal(t, second, articles[0]["id"], "group listing should keep the votes ranking")
+	assert.Equal(t, float64(1), client.ZScore(ctx, common.Votes+":programming", second).Val())
+
+	articles = articleRepo.GetGroupArticle(ctx, "redis", common.Time, 1)
+	assert.EqualValues(t, 1, len(articles), "redis group should have 1 article")
+
+	articleRepo.AddRemoveGroups(ctx, first, nil, []string{"redis"})
+	assert.EqualValues(t, 0, client.SCard(ctx, common.GroupPre+"redis").Val(), "redis group should be empty")
+}
+
+func TestGetArticlesPagination(t *testing.T) {
+	skipWithoutRedis(t)
+	defer articleRepo.Reset(ctx)
+
+	repo := &ArticleRepo{client: client, PageSize: 2}
+	for i := 0; i < 5; i++ {
+		repo.PostArticle(ctx, "hualulu", "page article", "http://www.hualubang.com/page")
+	}
+
+	assert.EqualValues(t, 2, len(repo.GetArticles(ctx, 1, common.Time)), "first page should be full")
+	assert.EqualValues(t, 1, len(repo.GetArticles(ctx, 3, common.Time)), "last page should have 1 article")
+	assert.EqualValues(t, 0, len(repo.GetArticles(ctx, 4, common.Time)), "page past the end should be empty")
+}
+
+func TestArticleVoteSwitch(t *testing.T) {
+	skipWithoutRedis(t)
+	defer articleRepo.Reset(ctx)
+
+	articleID, _ := articleRepo.PostArticle(ctx, "hualulu", "vote switch", "http://www.hualubang.com/5")
+	posted := client.ZScore(ctx, common.Score, articleID).Val()
+
+	articleRepo.ArticleUpVote(ctx, articleID, "lurenjia")
+	articleRepo.ArticleUpVote(ctx, articleID, "lurenjia")
+	assert.Equal(t, "1", client.HGet(ctx, common.ArticleHashSetPre+articleID, "votes").Val(), "repeated vote should count once")
+
+	articleRepo.ArticleDownVote(ctx, articleID, "lurenjia")
+	assert.Equal(t, "-1", client.HGet(ctx, common.ArticleHashSetPre+articleID, "votes").Val(), "switched vote should be -1")
+	assert.Equal(t, posted-common.VotedScore, client.ZScore(ctx, common.Score, articleID).Val(), "score should drop by one vote")
+
+	articleRepo.ArticleDownVote(ctx, articleID, "hualulu")
+	assert.Equal(t, "-1", client.HGet(ctx, common.ArticleHashSetPre+articleID, "votes").Val(), "author can't vote")
+}
+
+func TestArticleLifecycle(t *testing.T) {
+	skipWithoutRedis(t)
+	defer articleRepo.Reset(ctx)
+
+	articleID, _ := articleRepo.PostArticle(ctx, "hualulu", "lifecycle", "http://www.hualubang.com/6")
+	articleRepo.AddRemoveGroups(ctx, articleID, []string{"redis"}, nil)
+
+	assert.Nil(t, articleRepo.EditArticle(ctx, articleID, "lifecycle edited", ""))
+	article := client.HGetAll(ctx, common.ArticleHashSetPre+articleID).Val()
+	assert.Equal(t, "lifecycle edited", article["title"], "title should be edited")
+	assert.Equal(t, "http://www.hualubang.com/6", article["link"], "link should be unchanged")
+
+	assert.Nil(t, articleRepo.DeleteArticle(ctx, articleID))
+	assert.Equal(t, ErrArticleNotFound, articleRepo.DeleteArticle(ctx, articleID))
+	assert.EqualValues(t, 0, client.ZCard(ctx, common.Score).Val(), "score should be empty")
+	assert.EqualValues(t, 0, client.SCard(ctx, common.GroupPre+"redis").Val(), "group should be empty")
+	assert.EqualValues(t, 0, client.Exists(ctx, common.VotedSetPre+articleID).Val(), "voted set should be deleted")
+
+	// 将发布时间改为一周多以前，使其投票截止
+	expiredID, _ := articleRepo.PostArticle(ctx, "hualulu", "expired", "http://www.hualubang.com/7")
+	commentID, _ := articleRepo.AddComment(ctx, expiredID, common.RootCommentID, "lurenjia", "archived comment")
+	client.ZAdd(ctx, common.Time, redis.Z{Score: float64(time.Now().Unix() - common.OneWeekInSeconds - 1), Member: expiredID})
+	assert.EqualValues(t, 1, articleRepo.archiveBatch(ctx, common.ArchiveBatchSize))
+
+	archived, err := articleRepo.GetArchivedArticle(ctx, expiredID)
+	assert.Nil(t, err)
+	assert.Equal(t, "expired", archived.Article["title"], "archived title should be kept")
+	assert.EqualValues(t, 1, len(archived.Comments), "comments should be archived")
+	assert.EqualValues(t, 0, client.Exists(ctx, common.CommentHashSetPre+commentID, common.ArticleCommentsPre+expiredID).Val(),
+		"comment keys should be removed")
+	assert.EqualValues(t, 0, client.ZCard(ctx, common.Time).Val(), "time should be empty")
+}
+
+func TestArticleRankers(t *testing.T) {
+	skipWithoutRedis(t)
+	defer articleRepo.Reset(ctx)
+
+	first, _ := articleRepo.PostArticle(ctx, "hualulu", "mostly liked", "http://www.hualubang.com/8")
+	second, _ := articleRepo.PostArticle(ctx, "guadandan", "controversial", "http://www.hualubang.com/9")
+
+	articleRepo.ArticleUpVote(ctx, first, "lurenjia")
+	articleRepo.ArticleUpVote(ctx, second, "lurenjia")
+	articleRepo.ArticleUpVote(ctx, second, "lurenyi")
+	articleRepo.ArticleUpVote(ctx, second, "lurenbing")
+	articleRepo.ArticleDownVote(ctx, second, "lurending")
+	articleRepo.ArticleDownVote(ctx, second, "lurenwu")
+
+	articles := articleRepo.GetArticles(ctx, 1, common.Votes)
+	assert.Equal(t, first, articles[1]["id"], "net votes are 1 and 1, the later article should tie-break first")
+
+	articles = articleRepo.GetArticles(ctx, 1, common.Best)
+	assert.Equal(t, second, articles[0]["id"], "more votes give a higher wilson lower bound")
+
+	articles = articleRepo.GetArticles(ctx, 1, "unknown")
+	assert.EqualValues(t, 2, len(articles), "unknown order should fall back to score")
+
+	assert.Greater(t, HotRanker{}.Rank(VoteStats{Posted: 0, Up: 10}, 3600), HotRanker{}.Rank(VoteStats{Posted: 0, Up: 10}, 7200), "hot should decay")
+}
+
+func TestArticleComments(t *testing.T) {
+	skipWithoutRedis(t)
+	defer articleRepo.Reset(ctx)
+
+	articleID, _ := articleRepo.PostArticle(ctx, "hualulu", "comments", "http://www.hualubang.com/10")
+
+	first, err := articleRepo.AddComment(ctx, articleID, common.RootCommentID, "lurenjia", "first")
+	assert.Nil(t, err)
+	second, _ := articleRepo.AddComment(ctx, articleID, common.RootCommentID, "lurenyi", "second")
+	reply, err := articleRepo.AddComment(ctx, articleID, first, "hualulu", "reply")
+	assert.Nil(t, err)
+
+	_, err = articleRepo.AddComment(ctx, articleID, "404", "hualulu", "orphan")
+	assert.Equal(t, ErrCommentNotFound, err)
+
+	assert.Nil(t, articleRepo.CommentUpVote(ctx, first, "lurenbing"))
+	assert.Nil(t, articleRepo.CommentDownVote(ctx, second, "lurenbing"))
+
+	comments := articleRepo.GetComments(ctx, articleID, common.RootCommentID, common.CommentTop, 1)
+	assert.EqualValues(t, 2, len(comments), "article should have 2 top level comments")
+	assert.Equal(t, first, comments[0]["id"], "up-voted comment should be on top")
+	assert.Equal(t, "1", comments[0]["replies"], "first comment should have 1 reply")
+
+	comments = articleRepo.GetComments(ctx, articleID, first, common.CommentNew, 1)
+	assert.Equal(t, reply, comments[0]["id"], "reply should be listed under its parent")
+
+	article, _ := articleRepo.GetArticle(ctx, articleID)
+	assert.Equal(t, "3", article["comments"], "article should count all comments")
+
+	assert.Nil(t, articleRepo.DeleteArticle(ctx, articleID))
+	assert.EqualValues(t, 0, client.Exists(ctx, common.CommentHashSetPre+reply).Val(), "comments should be deleted with the article")
+}
+
+func TestArticleEvents(t *testing.T) {
+	skipWithoutRedis(t)
+	defer articleRepo.Reset(ctx)
+
+	consumer := NewArticleEventConsumer(client, "analytics", "worker-1")
+	consumer.Block = 100 * time.Millisecond
+	assert.Nil(t, consumer.EnsureGroup(ctx, "$"))
+	assert.Nil(t, consumer.EnsureGroup(ctx, "$"), "creating an existing group should be a no-op")
+
+	articleID, _ := articleRepo.PostArticle(ctx, "hualulu", "events", "http://www.hualubang.com/11")
+	articleRepo.ArticleUpVote(ctx, articleID, "lurenjia")
+	articleRepo.ArticleDownVote(ctx, articleID, "lurenjia")
+	articleRepo.DeleteArticle(ctx, articleID)
+
+	messages, err := consumer.Read(ctx)
+	assert.Nil(t, err)
+	types := make([]string, 0, len(messages))
+	for _, msg := range messages {
+		types = append(types, ParseArticleEvent(msg).Type)
+	}
+	assert.Equal(t, []string{EventPosted, EventUpVoted, EventDownVoted, EventDeleted}, types)
+
+	// 未确认的消息可以被其他消费者领取
+	other := NewArticleEventConsumer(client, "analytics", "worker-2")
+	other.MinIdle = 0
+	reclaimed, err := other.Reclaim(ctx)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 4, len(reclaimed), "pending messages should be reclaimed")
+	assert.Nil(t, other.Ack(ctx, messages[0].ID, messages[1].ID, messages[2].ID, messages[3].ID))
+
+	replayed, err := consumer.Replay(ctx, messages[0].ID, 10)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 3, len(replayed), "replay should start after the given id")
+}
+
+func TestArticleLeaderboard(t *testing.T) {
+	skipWithoutRedis(t)
+	defer articleRepo.Reset(ctx)
+
+	first, _ := articleRepo.PostArticle(ctx, "hualulu", "top of the day", "http://www.hualubang.com/12")
+	second, _ := articleRepo.PostArticle(ctx, "guadandan", "runner up", "http://www.hualubang.com/13")
+
+	articleRepo.ArticleUpVote(ctx, first, "lurenjia")
+	articleRepo.ArticleUpVote(ctx, first, "lurenyi")
+	articleRepo.ArticleUpVote(ctx, second, "lurenjia")
+	// 改投反对票计为 -2
+	articleRepo.ArticleDownVote(ctx, first, "lurenyi")
+	articleRepo.ArticleUpVote(ctx, second, "lurenbing")
+
+	// 三天前的得票不计入最近 24 小时
+	client.ZIncrBy(ctx, leaderboardBucket(time.Now().Unix()-3*24*3600), 10, first)
+
+	articles := articleRepo.GetLeaderboard(ctx, common.LeaderboardDay, 1)
+	assert.EqualValues(t, 2, len(articles), "both articles were voted today")
+	assert.Equal(t, second, articles[0]["id"], "second article has more net votes today")
+
+	articles = articleRepo.GetLeaderboard(ctx, common.LeaderboardWeek, 1)
+	assert.Equal(t, first, articles[0]["id"], "first article has more net votes this week")
+
+	assert.Nil(t, articleRepo.DeleteArticle(ctx, first))
+	assert.EqualValues(t, 1, len(articleRepo.GetLeaderboard(ctx, common.LeaderboardWeek, 1)), "deleted article should leave the leaderboard")
+}
+
+func TestArticleVoteFraud(t *testing.T) {
+	skipWithoutRedis(t)
+	defer articleRepo.Reset(ctx)
+
+	articleID, _ := articleRepo.PostArticle(ctx, "hualulu", "sock puppets", "http://www.hualubang.com/14")
+
+	// 来自不同来源的投票正常计入
+	for i, user := range []string{"lurenjia", "lurenyi", "lurenbing"} {
+		source := VoteSource{IP: "10.0.0." + strconv.Itoa(i), Fingerprint: "device-" + user}
+		assert.Nil(t, articleRepo.ArticleVoteFrom(ctx, articleID, user, true, source))
+	}
+	// 同一 IP 的投票占比超过阈值后被隔离
+	puppet := VoteSource{IP: "10.0.0.9"}
+	for i := 1; i <= 3; i++ {
+		assert.Nil(t, articleRepo.ArticleVoteFrom(ctx, articleID, "puppet-"+strconv.Itoa(i), true, puppet))
+	}
+	assert.Equal(t, ErrVoteQuarantined, articleRepo.ArticleVoteFrom(ctx, articleID, "puppet-4", true, puppet))
+	assert.Equal(t, ErrVoteQuarantined, articleRepo.ArticleVoteFrom(ctx, articleID, "puppet-5", true, puppet))
+
+	article, _ := articleRepo.GetArticle(ctx, articleID)
+	assert.Equal(t, "6", article["votes"], "quarantined votes should not be counted")
+
+	flagged, _ := articleRepo.GetFlaggedArticles(ctx)
+	assert.Equal(t, []string{articleID}, flagged)
+	votes, _ := articleRepo.GetQuarantinedVotes(ctx, articleID)
+	assert.EqualValues(t, 2, len(votes))
+
+	assert.Nil(t, articleRepo.ReviewVote(ctx, articleID, "puppet-4", true))
+	assert.Nil(t, articleRepo.ReviewVote(ctx, articleID, "puppet-5", false))
+	assert.Equal(t, ErrVoteNotQuarantined, articleRepo.ReviewVote(ctx, articleID, "puppet-5", true))
+
+	article, _ = articleRepo.GetArticle(ctx, articleID)
+	assert.Equal(t, "7", article["votes"], "accepted vote should be counted")
+	flagged, _ = articleRepo.GetFlaggedArticles(ctx)
+	assert.EqualValues(t, 0, len(flagged), "article should be unflagged after review")
+
+	// 改投相反的票不重复计入来源
+	total := client.HGet(ctx, common.VoteSourcesPre+articleID, "total").Val()
+	assert.Nil(t, articleRepo.ArticleVoteFrom(ctx, articleID, "lurenjia", false, VoteSource{IP: "10.0.0.0"}))
+	assert.Equal(t, total, client.HGet(ctx, common.VoteSourcesPre+articleID, "total").Val())
+
+	// 不存在的文章不记录来源
+	assert.Equal(t, ErrArticleNotFound, articleRepo.ArticleVoteFrom(ctx, "missing", "lurenjia", true, puppet))
+	assert.EqualValues(t, 0, client.Exists(ctx, common.VoteSourcesPre+"missing").Val())
+
+	// 隔离中的用户不能绕过审核直接投票
+	assert.Equal(t, ErrVoteQuarantined, articleRepo.ArticleVoteFrom(ctx, articleID, "puppet-6", true, puppet))
+	article, _ = articleRepo.GetArticle(ctx, articleID)
+	votes6 := article["votes"]
+	assert.Nil(t, articleRepo.ArticleUpVote(ctx, articleID, "puppet-6"))
+	article, _ = articleRepo.GetArticle(ctx, articleID)
+	assert.Equal(t, votes6, article["votes"], "quarantined user should not vote directly")
+
+	// 投票截止后审核通过的投票已过期，隔离记录仍被移除
+	client.ZAdd(ctx, common.Time, redis.Z{Score: float64(time.Now().Unix() - common.OneWeekInSeconds - 1), Member: articleID})
+	assert.Equal(t, ErrVotingClosed, articleRepo.ReviewVote(ctx, articleID, "puppet-6", true))
+	assert.Equal(t, ErrVoteNotQuarantined, articleRepo.ReviewVote(ctx, articleID, "puppet-6", true))
+	flagged, _ = articleRepo.GetFlaggedArticles(ctx)
+	assert.EqualValues(t, 0, len(flagged), "expired vote should be removed from review")
+}
+
+func TestArticleExportImport(t *testing.T) {
+	skipWithoutRedis(t)
+	defer articleRepo.Reset(ctx)
+
+	articleID, _ := articleRepo.PostArticle(ctx, "hualulu", "snapshot", "http://www.hualubang.com/15")
+	articleRepo.AddRemoveGroups(ctx, articleID, []string{"redis"}, nil)
+	articleRepo.ArticleUpVote(ctx, articleID, "lurenjia")
+
+	var buf bytes.Buffer
+	n, err := articleRepo.Export(ctx, &buf)
+	assert.Nil(t, err)
+	assert.Greater(t, n, int64(0))
+
+	// 修改后以跳过模式导入不会覆盖，覆盖模式导入恢复快照
+	articleRepo.EditArticle(ctx, articleID, "changed", "")
+	stats, err := articleRepo.Import(ctx, bytes.NewReader(buf.Bytes()), ImportSkipExisting)
+	assert.Nil(t, err)
+	assert.EqualValues(t, n, stats.Skipped)
+	assert.Equal(t, "changed", client.HGet(ctx, common.ArticleHashSetPre+articleID, "title").Val())
+
+	// 跳过模式下 id 计数器仍会提高到导入的最大 id
+	client.Set(ctx, common.ArticleID, "0", 0)
+	_, err = articleRepo.Import(ctx, bytes.NewReader(buf.Bytes()), ImportSkipExisting)
+	assert.Nil(t, err)
+	assert.Equal(t, articleID, client.Get(ctx, common.ArticleID).Val())
+	assert.EqualValues(t, 0, len(client.Keys(ctx, common.ImportStagingPre+"*").Val()), "staging keys should be removed")
+
+	articleRepo.Reset(ctx)
+	stats, err = articleRepo.Import(ctx, bytes.NewReader(buf.Bytes()), ImportOverwrite)
+	assert.Nil(t, err)
+	assert.EqualValues(t, n, stats.Imported)
+
+	article, _ := articleRepo.GetArticle(ctx, articleID)
+	assert.Equal(t, "snapshot", article["title"])
+	assert.Equal(t, "redis", article["groups"])
+	assert.Greater(t, client.TTL(ctx, common.VotedSetPre+articleID).Val(), time.Duration(0), "voted set ttl should be restored")
+	assert.EqualValues(t, 2, client.SCard(ctx, common.VotedSetPre+articleID).Val())
+}
+
+func TestArticleRecommendations(t *testing.T) {
+	skipWithoutRedis(t)
+	defer articleRepo.Reset(ctx)
+
+	redisArticle, _ := articleRepo.PostArticle(ctx, "hualulu", "redis in action", "http://www.hualubang.com/16")
+	goArticle, _ := articleRepo.PostArticle(ctx, "hualulu", "go in action", "http://www.hualubang.com/17")
+	rustArticle, _ := articleRepo.PostArticle(ctx, "hualulu", "rust in action", "http://www.hualubang.com/18")
+
+	// lurenyi 和 lurenbing 都投了 redis 和 go，lurending 投了 rust
+	for _, user := range []string{"lurenyi", "lurenbing"} {
+		articleRepo.ArticleUpVote(ctx, redisArticle, user)
+		articleRepo.ArticleUpVote(ctx, goArticle, user)
+	}
+	articleRepo.ArticleUpVote(ctx, rustArticle, "lurending")
+	articleRepo.ArticleUpVote(ctx, redisArticle, "lurenjia")
+
+	articles, err := articleRepo.RecommendFor(ctx, "lurenjia", 10)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 1, len(articles), "only go article is co-voted with redis article")
+	assert.Equal(t, goArticle, articles[0]["id"])
+
+	// 投过票后不再推荐
+	articleRepo.ArticleDownVote(ctx, goArticle, "lurenjia")
+	articles, _ = articleRepo.RecommendFor(ctx, "lurenjia", 10)
+	assert.EqualValues(t, 0, len(articles), "voted articles should be excluded")
+
+	// 没有可推荐的文章时也缓存结果
+	articles, err = articleRepo.RecommendFor(ctx, "nobody", 10)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 0, len(articles))
+	assert.EqualValues(t, 1, client.Exists(ctx, common.RecommendationsPre+"nobody").Val(), "empty recommendations should be cached")
+}
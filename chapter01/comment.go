@@ -0,0 +1,201 @@
+package chapter01
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"redis-practice/common"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+// AddComment 发表评论，parentID 为 common.RootCommentID 时直接回复文章，否则回复该评论，返回新评论 id
+func (r ArticleRepo) AddComment(ctx context.Context, articleID, parentID, author, body string) (string, error) {
+	if parentID == "" {
+		parentID = common.RootCommentID
+	}
+	articleKey := common.ArticleHashSetPre + articleID
+	parentKey := common.CommentHashSetPre + parentID
+
+	var commentID string
+	// 监视文章和父评论，避免评论挂到并发删除的文章上
+	err := r.client.Watch(ctx, func(tx *redis.Tx) error {
+		if tx.Exists(ctx, articleKey).Val() == 0 {
+			return ErrArticleNotFound
+		}
+		if parentID != common.RootCommentID && tx.HGet(ctx, parentKey, "article").Val() != articleID {
+			return ErrCommentNotFound
+		}
+
+		commentID = strconv.FormatInt(tx.Incr(ctx, common.CommentID).Val(), 10)
+		now := time.Now().Unix()
+		deadline := time.Unix(now+common.OneWeekInSeconds, 0)
+
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, common.CommentHashSetPre+commentID, map[string]any{
+				"id":        commentID,
+				"article":   articleID,
+				"parent":    parentID,
+				"poster":    author,
+				"body":      body,
+				"time":      now,
+				"votes":     0,
+				"upvotes":   0,
+				"downvotes": 0,
+				"replies":   0,
+			})
+			// 与文章相同，作者不能给自己的评论投票
+			for _, votedSetKey := range []string{common.CommentVotedSetPre + commentID, common.CommentDownVotedSetPre + commentID} {
+				pipe.SAdd(ctx, votedSetKey, author)
+				pipe.ExpireAt(ctx, votedSetKey, deadline)
+			}
+			pipe.ZAdd(ctx, commentNewKey(articleID, parentID), redis.Z{Score: float64(now), Member: commentID})
+			pipe.ZAdd(ctx, commentTopKey(articleID, parentID), redis.Z{Score: 0, Member: commentID})
+			pipe.SAdd(ctx, common.ArticleCommentsPre+articleID, commentID)
+			pipe.HIncrBy(ctx, articleKey, "comments", 1)
+			if parentID != common.RootCommentID {
+				pipe.HIncrBy(ctx, parentKey, "replies", 1)
+			}
+			return nil
+		})
+		return err
+	}, articleKey, parentKey)
+	if err != nil {
+		return "", err
+	}
+
+	return commentID, nil
+}
+
+// CommentUpVote 给评论投赞成票，规则与文章投票相同
+func (r ArticleRepo) CommentUpVote(ctx context.Context, commentID, user string) error {
+	return r.voteComment(ctx, commentID, user, true)
+}
+
+// CommentDownVote 给评论投反对票，规则与文章投票相同
+func (r ArticleRepo) CommentDownVote(ctx context.Context, commentID, user string) error {
+	return r.voteComment(ctx, commentID, user, false)
+}
+
+func (r ArticleRepo) voteComment(ctx context.Context, commentID, user string, up bool) error {
+	if err := common.CheckRateLimit(ctx, r.VoteLimiter, "vote:"+user); err != nil {
+		return err
+	}
+
+	hashKey := common.CommentHashSetPre + commentID
+	values := r.client.HMGet(ctx, hashKey, "article", "parent").Val()
+	articleID, _ := values[0].(string)
+	parentID, _ := values[1].(string)
+	if articleID == "" {
+		return ErrCommentNotFound
+	}
+
+	// 评论的发布时间记录在同级回复的时间有序集合中
+	res, err := r.runVote(ctx, commentNewKey(articleID, parentID), common.CommentVotedSetPre+commentID,
+		common.CommentDownVotedSetPre+commentID, hashKey, commentID, user, up)
+	if err != nil {
+		return err
+	}
+
+	switch res {
+	case -2:
+		return ErrCommentNotFound
+	case -1:
+		return ErrVotingClosed
+	case 1, 2:
+		if err := r.updateCommentTop(ctx, articleID, parentID, commentID); err != nil {
+			logrus.Errorf("update comment %s rank failed, err: %v", commentID, err)
+		}
+	}
+	return nil
+}
+
+// updateCommentTop 根据评论哈希中的净票数更新最高票排序
+func (r ArticleRepo) updateCommentTop(ctx context.Context, articleID, parentID, commentID string) error {
+	hashKey := common.CommentHashSetPre + commentID
+
+	return r.client.Watch(ctx, func(tx *redis.Tx) error {
+		votes, err := tx.HGet(ctx, hashKey, "votes").Float64()
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.ZAddXX(ctx, commentTopKey(articleID, parentID), redis.Z{Score: votes, Member: commentID})
+			return nil
+		})
+		return err
+	}, hashKey)
+}
+
+// GetComments 分页获取文章中某条评论的直接回复，parentID 为 common.RootCommentID 时获取文章的顶层评论，
+// order 为 common.CommentNew 或 common.CommentTop，每条评论的 replies 字段为其回复数
+func (r ArticleRepo) GetComments(ctx context.Context, articleID, parentID, order string, page int64) []map[string]string {
+	if parentID == "" {
+		parentID = common.RootCommentID
+	}
+	key := commentNewKey(articleID, parentID)
+	if order == common.CommentTop {
+		key = commentTopKey(articleID, parentID)
+	}
+
+	if page < 1 {
+		page = 1
+	}
+	size := r.pageSize()
+	start := (page - 1) * size
+
+	ids, err := r.client.ZRevRange(ctx, key, start, start+size-1).Result()
+	if err != nil || len(ids) == 0 {
+		return []map[string]string{}
+	}
+
+	cmds := make([]*redis.MapStringStringCmd, 0, len(ids))
+	_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, commentID := range ids {
+			cmds = append(cmds, pipe.HGetAll(ctx, common.CommentHashSetPre+commentID))
+		}
+		return nil
+	})
+	if err != nil {
+		logrus.Error("get comments pipeline failed, err: ", err)
+		return []map[string]string{}
+	}
+
+	comments := make([]map[string]string, 0, len(cmds))
+	for _, cmd := range cmds {
+		if comment := cmd.Val(); len(comment) != 0 {
+			comments = append(comments, comment)
+		}
+	}
+	return comments
+}
+
+// removeComments 在流水线中删除文章的所有评论
+func (r ArticleRepo) removeComments(ctx context.Context, pipe redis.Pipeliner, articleID string, commentIDs []string) {
+	keys := make([]string, 0, len(commentIDs)*5+3)
+	keys = append(keys,
+		common.ArticleCommentsPre+articleID,
+		commentNewKey(articleID, common.RootCommentID),
+		commentTopKey(articleID, common.RootCommentID),
+	)
+	for _, commentID := range commentIDs {
+		keys = append(keys,
+			common.CommentHashSetPre+commentID,
+			common.CommentVotedSetPre+commentID,
+			common.CommentDownVotedSetPre+commentID,
+			commentNewKey(articleID, commentID),
+			commentTopKey(articleID, commentID),
+		)
+	}
+	pipe.Del(ctx, keys...)
+}
+
+func commentNewKey(articleID, parentID string) string {
+	return common.CommentNewPre + articleID + ":" + parentID
+}
+
+func commentTopKey(articleID, parentID string) string {
+	return common.CommentTopPre + articleID + ":" + parentID
+}
@@ -4,11 +4,12 @@ import "time"
 
 // Article represents a blog article
 type Article struct {
-	ID       int
-	Title    string
-	Author   string
-	Link     string
-	PostTime time.Time
-	Votes    int
-	Group    string
+	ID       int       `json:"id"`
+	Title    string    `json:"title"`
+	Author   string    `json:"author"`
+	Link     string    `json:"link"`
+	PostTime time.Time `json:"post_time"`
+	Votes    int       `json:"votes"`
+	Comments int       `json:"comments"`
+	Group    string    `json:"group"` // 逗号分隔的所属分组
 }
@@ -0,0 +1,405 @@
+package chapter01
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"redis-practice/common"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ImportMode 导入时目标 key 已存在的处理方式
+type ImportMode int
+
+const (
+	// ImportSkipExisting 跳过已存在的 key
+	ImportSkipExisting ImportMode = iota
+	// ImportOverwrite 覆盖已存在的 key
+	ImportOverwrite
+)
+
+const (
+	// dumpScanCount 每次 SCAN 的建议数量
+	dumpScanCount = 1000
+	// importBatchSize 每个导入流水线中的 key 数量
+	importBatchSize = 500
+	// importMaxLineSize 导入时单行 json 的最大字节数
+	importMaxLineSize = 64 << 20
+)
+
+// DumpRecord 导出文件中的一行，对应一个 redis key
+type DumpRecord struct {
+	Key  string `json:"key"`
+	Type string `json:"type"`
+	// TTL 导出时剩余的毫秒数，0 表示不过期
+	TTL   int64           `json:"ttl,omitempty"`
+	Value json.RawMessage `json:"value"`
+}
+
+// ImportStats 导入结果统计
+type ImportStats struct {
+	Imported int64
+	Skipped  int64
+}
+
+type dumpMember struct {
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+}
+
+// dumpPatterns 返回第一章所有持久数据的 key 模式，不含分组排序、滚动排行榜等可重建的缓存
+func (r ArticleRepo) dumpPatterns() []string {
+	patterns := []string{
+		common.ArticleID,
+		common.ArticleHashSetPre + "*",
+		common.Time,
+		common.VotedSetPre + "*",
+		common.DownVotedSetPre + "*",
+		common.GroupPre + "*",
+		common.ArticleGroupsPre + "*",
+		common.ArticleArchive,
+		common.LeaderboardPre + "*",
+		common.CommentID,
+		common.CommentHashSetPre + "*",
+		common.CommentVotedSetPre + "*",
+		common.CommentDownVotedSetPre + "*",
+		common.ArticleCommentsPre + "*",
+		common.CommentNewPre + "*",
+		common.CommentTopPre + "*",
+		common.VoteSourcesPre + "*",
+		common.QuarantinedVotesPre + "*",
+		common.FlaggedArticles,
+		common.UserVotedPre + "*",
+		common.RecentVoters,
+	}
+	for _, ranker := range r.rankers() {
+		patterns = append(patterns, ranker.Name())
+	}
+	return patterns
+}
+
+// Export 以 JSON Lines 格式流式导出第一章的所有数据，返回导出的 key 数
+func (r ArticleRepo) Export(ctx context.Context, w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	encoder := json.NewEncoder(bw)
+
+	var exported int64
+	for _, pattern := range r.dumpPatterns() {
+		keys := []string{pattern}
+		var cursor uint64
+		for {
+			if strings.HasSuffix(pattern, "*") {
+				var err error
+				keys, cursor, err = r.client.Scan(ctx, cursor, pattern, dumpScanCount).Result()
+				if err != nil {
+					return exported, err
+				}
+			}
+
+			records, err := r.dumpKeys(ctx, keys)
+			if err != nil {
+				return exported, err
+			}
+			for _, record := range records {
+				if err := encoder.Encode(record); err != nil {
+					return exported, err
+				}
+			}
+			exported += int64(len(records))
+
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+
+	return exported, bw.Flush()
+}
+
+// dumpKeys 流水线读取一批 key 的类型、过期时间和值，跳过不存在或读取期间被删除的 key
+func (r ArticleRepo) dumpKeys(ctx context.Context, keys []string) ([]*DumpRecord, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	typeCmds := make([]*redis.StatusCmd, 0, len(keys))
+	ttlCmds := make([]*redis.DurationCmd, 0, len(keys))
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			typeCmds = append(typeCmds, pipe.Type(ctx, key))
+			ttlCmds = append(ttlCmds, pipe.PTTL(ctx, key))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	valueCmds := make([]redis.Cmder, len(keys))
+	_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			switch typeCmds[i].Val() {
+			case "string":
+				valueCmds[i] = pipe.Get(ctx, key)
+			case "hash":
+				valueCmds[i] = pipe.HGetAll(ctx, key)
+			case "set":
+				valueCmds[i] = pipe.SMembers(ctx, key)
+			case "zset":
+				valueCmds[i] = pipe.ZRangeWithScores(ctx, key, 0, -1)
+			}
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	records := make([]*DumpRecord, 0, len(keys))
+	for i, key := range keys {
+		var value any
+		switch cmd := valueCmds[i].(type) {
+		case *redis.StringCmd:
+			if cmd.Err() == redis.Nil {
+				continue
+			}
+			value = cmd.Val()
+		case *redis.MapStringStringCmd:
+			value = cmd.Val()
+		case *redis.StringSliceCmd:
+			value = cmd.Val()
+		case *redis.ZSliceCmd:
+			members := make([]dumpMember, 0, len(cmd.Val()))
+			for _, z := range cmd.Val() {
+				members = append(members, dumpMember{Member: z.Member.(string), Score: z.Score})
+			}
+			value = members
+		default:
+			continue
+		}
+
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		record := &DumpRecord{Key: key, Type: typeCmds[i].Val(), Value: data}
+		if ttl := ttlCmds[i].Val(); ttl > 0 {
+			record.TTL = ttl.Milliseconds()
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// importCounters 导入时只增不减的 id 计数器，value 为以 id 结尾的哈希 key 前缀
+var importCounters = map[string]string{
+	common.ArticleID: common.ArticleHashSetPre,
+	common.CommentID: common.CommentHashSetPre,
+}
+
+// raiseCounterScript 计数器小于 ARGV[1] 时设置为 ARGV[1]，返回是否修改
+var raiseCounterScript = redis.NewScript(`
+local current = tonumber(redis.call('GET', KEYS[1]) or '0')
+if current >= tonumber(ARGV[1]) then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[1])
+return 1
+`)
+
+// Import 从 JSON Lines 格式的导出数据批量导入。
+// id 计数器不受 mode 影响，只会提高到导出的计数器值和导入的最大文章、评论 id，避免之后分配重复的 id
+func (r ArticleRepo) Import(ctx context.Context, rd io.Reader, mode ImportMode) (*ImportStats, error) {
+	scanner := bufio.NewScanner(rd)
+	scanner.Buffer(make([]byte, 0, 64*1024), importMaxLineSize)
+
+	stats := &ImportStats{}
+	batch := make([]*DumpRecord, 0, importBatchSize)
+	counters := make(map[string]int64, len(importCounters))
+	exported := make(map[string]bool, len(importCounters))
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		record := &DumpRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			return stats, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		if _, ok := importCounters[record.Key]; ok {
+			var value string
+			if err := json.Unmarshal(record.Value, &value); err != nil {
+				return stats, fmt.Errorf("line %d: %w", line, err)
+			}
+			id, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return stats, fmt.Errorf("line %d: %w", line, err)
+			}
+			raiseImportCounter(counters, record.Key, id)
+			exported[record.Key] = true
+			continue
+		}
+		for counter, prefix := range importCounters {
+			if !strings.HasPrefix(record.Key, prefix) {
+				continue
+			}
+			if id, err := strconv.ParseInt(strings.TrimPrefix(record.Key, prefix), 10, 64); err == nil {
+				raiseImportCounter(counters, counter, id)
+			}
+		}
+
+		batch = append(batch, record)
+		if len(batch) == importBatchSize {
+			if err := r.importBatch(ctx, batch, mode, stats); err != nil {
+				return stats, err
+			}
+			batch = batch[:0]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return stats, err
+	}
+	if err := r.importBatch(ctx, batch, mode, stats); err != nil {
+		return stats, err
+	}
+
+	for counter, id := range counters {
+		raised, err := raiseCounterScript.Run(ctx, r.client, []string{counter}, id).Bool()
+		if err != nil {
+			return stats, err
+		}
+		if !exported[counter] {
+			continue
+		}
+		if raised {
+			stats.Imported++
+		} else {
+			stats.Skipped++
+		}
+	}
+	return stats, nil
+}
+
+// raiseImportCounter 记录计数器需要提高到的最大 id
+func raiseImportCounter(counters map[string]int64, counter string, id int64) {
+	if id > counters[counter] {
+		counters[counter] = id
+	}
+}
+
+// importBatch 在一个事务中导入一批 key，每个 key 先写入临时 key 再改名为目标 key，
+// 跳过模式下用 RENAMENX 保证检查目标 key 不存在与写入是原子的
+func (r ArticleRepo) importBatch(ctx context.Context, batch []*DumpRecord, mode ImportMode, stats *ImportStats) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	var imported, skipped int64
+	renamed := make([]*redis.BoolCmd, 0, len(batch))
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, record := range batch {
+			staging := common.ImportStagingPre + record.Key
+			pipe.Del(ctx, staging)
+			written, err := restoreRecord(ctx, pipe, staging, record)
+			if err != nil {
+				return fmt.Errorf("key %s: %w", record.Key, err)
+			}
+			// 空集合没有可写入的值
+			if !written {
+				skipped++
+				continue
+			}
+			if record.TTL > 0 {
+				pipe.PExpire(ctx, staging, time.Duration(record.TTL)*time.Millisecond)
+			}
+
+			if mode == ImportSkipExisting {
+				renamed = append(renamed, pipe.RenameNX(ctx, staging, record.Key))
+				pipe.Del(ctx, staging)
+			} else {
+				pipe.Rename(ctx, staging, record.Key)
+				imported++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, cmd := range renamed {
+		if cmd.Val() {
+			imported++
+		} else {
+			skipped++
+		}
+	}
+	stats.Imported += imported
+	stats.Skipped += skipped
+	return nil
+}
+
+// restoreRecord 在流水线中按类型将记录的值写入 key，值为空集合时不写入并返回 false
+func restoreRecord(ctx context.Context, pipe redis.Pipeliner, key string, record *DumpRecord) (bool, error) {
+	switch record.Type {
+	case "string":
+		var value string
+		if err := json.Unmarshal(record.Value, &value); err != nil {
+			return false, err
+		}
+		pipe.Set(ctx, key, value, 0)
+		return true, nil
+
+	case "hash":
+		var value map[string]string
+		if err := json.Unmarshal(record.Value, &value); err != nil {
+			return false, err
+		}
+		if len(value) == 0 {
+			return false, nil
+		}
+		pipe.HSet(ctx, key, value)
+		return true, nil
+
+	case "set":
+		var value []string
+		if err := json.Unmarshal(record.Value, &value); err != nil {
+			return false, err
+		}
+		if len(value) == 0 {
+			return false, nil
+		}
+		members := make([]any, 0, len(value))
+		for _, member := range value {
+			members = append(members, member)
+		}
+		pipe.SAdd(ctx, key, members...)
+		return true, nil
+
+	case "zset":
+		var value []dumpMember
+		if err := json.Unmarshal(record.Value, &value); err != nil {
+			return false, err
+		}
+		if len(value) == 0 {
+			return false, nil
+		}
+		members := make([]redis.Z, 0, len(value))
+		for _, m := range value {
+			members = append(members, redis.Z{Member: m.Member, Score: m.Score})
+		}
+		pipe.ZAdd(ctx, key, members...)
+		return true, nil
+	}
+	return false, fmt.Errorf("unsupported type %q", record.Type)
+}
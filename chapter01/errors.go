@@ -0,0 +1,16 @@
+package chapter01
+
+import "errors"
+
+var (
+	// ErrArticleNotFound 文章不存在
+	ErrArticleNotFound = errors.New("article not found")
+	// ErrVotingClosed 文章已超过投票截止时间
+	ErrVotingClosed = errors.New("voting has closed")
+	// ErrCommentNotFound 评论不存在或不属于该文章
+	ErrCommentNotFound = errors.New("comment not found")
+	// ErrVoteQuarantined 投票来源可疑，已隔离等待审核，暂不计入得分
+	ErrVoteQuarantined = errors.New("vote quarantined for review")
+	// ErrVoteNotQuarantined 没有该用户待审核的投票
+	ErrVoteNotQuarantined = errors.New("no quarantined vote for user")
+)
@@ -0,0 +1,69 @@
+package chapter01
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"redis-practice/common"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+// 文章事件类型
+const (
+	EventPosted    = "posted"
+	EventUpVoted   = "upvoted"
+	EventDownVoted = "downvoted"
+	EventDeleted   = "deleted"
+)
+
+// ArticleEvent 写入 common.ArticleEvents stream 的文章事件
+type ArticleEvent struct {
+	// ID stream 消息 id
+	ID        string
+	Type      string
+	ArticleID string
+	// User 发文、投票的用户，删除事件为空
+	User string
+	Time int64
+}
+
+// ParseArticleEvent 将 stream 消息解析为文章事件
+func ParseArticleEvent(msg redis.XMessage) ArticleEvent {
+	event := ArticleEvent{ID: msg.ID}
+	event.Type, _ = msg.Values["type"].(string)
+	event.ArticleID, _ = msg.Values["article"].(string)
+	event.User, _ = msg.Values["user"].(string)
+	ts, _ := msg.Values["time"].(string)
+	event.Time, _ = strconv.ParseInt(ts, 10, 64)
+	return event
+}
+
+// NewArticleEventConsumer 创建消费文章事件的消费者组消费者
+func NewArticleEventConsumer(client *common.Client, group, consumer string) *common.StreamConsumer {
+	return common.NewStreamConsumer(client, common.ArticleEvents, group, consumer)
+}
+
+// addEvent 在流水线中追加文章事件，stream 长度近似保持在 common.ArticleEventsMaxLen 以内
+func addEvent(ctx context.Context, pipe redis.Cmdable, eventType, articleID, user string) *redis.StringCmd {
+	return pipe.XAdd(ctx, &redis.XAddArgs{
+		Stream: common.ArticleEvents,
+		MaxLen: common.ArticleEventsMaxLen,
+		Approx: true,
+		Values: map[string]any{
+			"type":    eventType,
+			"article": articleID,
+			"user":    user,
+			"time":    time.Now().Unix(),
+		},
+	})
+}
+
+// publishEvent 追加文章事件，失败只记录日志
+func (r ArticleRepo) publishEvent(ctx context.Context, eventType, articleID, user string) {
+	if err := addEvent(ctx, r.client, eventType, articleID, user).Err(); err != nil {
+		logrus.Errorf("publish article %s %s event failed, err: %v", articleID, eventType, err)
+	}
+}
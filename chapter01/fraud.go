@@ -0,0 +1,191 @@
+package chapter01
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"redis-practice/common"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// VoteSource 投票来源，用于识别同一来源的刷票
+type VoteSource struct {
+	IP          string `json:"ip,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// QuarantinedVote 被隔离等待审核的投票
+type QuarantinedVote struct {
+	User   string     `json:"user"`
+	Up     bool       `json:"up"`
+	Source VoteSource `json:"source"`
+	Time   int64      `json:"time"`
+}
+
+// fraudScript 检查文章存在且仍可投票后记录投票来源，某个来源的投票占比过高时隔离该投票并标记文章，
+// 改投相反的票时来源已计数过，不再重复计数
+//
+// KEYS: 来源计数哈希, 隔离投票哈希, 被标记文章有序集合, 本方投票集合, time, 对方投票集合
+// ARGV: 文章 id, 用户, ip 来源, 指纹来源, 占比阈值, 最少投票数, 隔离投票 json, 过期秒数, 当前时间
+// 返回: -2 表示不存在，-1 表示投票已截止，0 表示已投过或已在隔离中，1 表示已隔离，2 表示正常
+var fraudScript = redis.NewScript(`
+local posted = redis.call('ZSCORE', KEYS[5], ARGV[1])
+if not posted then
+	return -2
+end
+if tonumber(ARGV[9]) > tonumber(posted) + tonumber(ARGV[8]) then
+	return -1
+end
+if redis.call('SISMEMBER', KEYS[4], ARGV[2]) == 1 or redis.call('HEXISTS', KEYS[2], ARGV[2]) == 1 then
+	return 0
+end
+if redis.call('SISMEMBER', KEYS[6], ARGV[2]) == 1 then
+	return 2
+end
+local total = redis.call('HINCRBY', KEYS[1], 'total', 1)
+redis.call('EXPIRE', KEYS[1], ARGV[8])
+local suspicious = false
+for i = 3, 4 do
+	if ARGV[i] ~= '' then
+		local n = redis.call('HINCRBY', KEYS[1], ARGV[i], 1)
+		if total >= tonumber(ARGV[6]) and n / total > tonumber(ARGV[5]) then
+			suspicious = true
+		end
+	end
+end
+if not suspicious then
+	return 2
+end
+redis.call('HSET', KEYS[2], ARGV[2], ARGV[7])
+redis.call('ZINCRBY', KEYS[3], 1, ARGV[1])
+return 1
+`)
+
+// ArticleVoteFrom 带来源的投票，同一 IP 或设备指纹的投票占比超过 common.VoteFraudShare 时
+// 投票被隔离并返回 ErrVoteQuarantined，等待 ReviewVote 审核后才计入得分。
+// 没有来源的投票不会被隔离，但仍计入总投票数，用户已有投票在隔离中时不会计入
+func (r ArticleRepo) ArticleVoteFrom(ctx context.Context, articleID, user string, up bool, source VoteSource) error {
+	if err := common.CheckRateLimit(ctx, r.VoteLimiter, "vote:"+user); err != nil {
+		return err
+	}
+	votedSetKey, otherSetKey := common.VotedSetPre+articleID, common.DownVotedSetPre+articleID
+	if !up {
+		votedSetKey, otherSetKey = otherSetKey, votedSetKey
+	}
+	now := time.Now().Unix()
+	payload, err := json.Marshal(&QuarantinedVote{User: user, Up: up, Source: source, Time: now})
+	if err != nil {
+		return err
+	}
+
+	var ip, fingerprint string
+	if source.IP != "" {
+		ip = "ip:" + source.IP
+	}
+	if source.Fingerprint != "" {
+		fingerprint = "fp:" + source.Fingerprint
+	}
+
+	res, err := fraudScript.Run(ctx, r.client,
+		[]string{common.VoteSourcesPre + articleID, common.QuarantinedVotesPre + articleID, common.FlaggedArticles,
+			votedSetKey, common.Time, otherSetKey},
+		articleID, user, ip, fingerprint, common.VoteFraudShare, common.VoteFraudMinVotes, payload, common.OneWeekInSeconds, now,
+	).Int()
+	if err != nil {
+		return err
+	}
+
+	switch res {
+	case -2:
+		return ErrArticleNotFound
+	case -1:
+		return ErrVotingClosed
+	case 1:
+		return ErrVoteQuarantined
+	case 2:
+		return r.applyVote(ctx, articleID, user, up)
+	}
+	return nil
+}
+
+// GetFlaggedArticles 获取有待审核投票的文章 id，按待审核投票数从多到少排序
+func (r ArticleRepo) GetFlaggedArticles(ctx context.Context) ([]string, error) {
+	return r.client.ZRevRangeByScore(ctx, common.FlaggedArticles, &redis.ZRangeBy{Min: "(0", Max: "+inf"}).Result()
+}
+
+// GetQuarantinedVotes 获取文章待审核的投票
+func (r ArticleRepo) GetQuarantinedVotes(ctx context.Context, articleID string) ([]QuarantinedVote, error) {
+	values, err := r.client.HVals(ctx, common.QuarantinedVotesPre+articleID).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	votes := make([]QuarantinedVote, 0, len(values))
+	for _, value := range values {
+		var vote QuarantinedVote
+		if err := json.Unmarshal([]byte(value), &vote); err != nil {
+			return nil, err
+		}
+		votes = append(votes, vote)
+	}
+	return votes, nil
+}
+
+// ReviewVote 审核被隔离的投票，accept 为 true 时计入得分，否则丢弃。
+// 先计入投票再移除隔离记录，计入失败时隔离记录保留以便重新审核，重复计入同一投票不会重复计票；
+// 文章已截止投票或不存在时投票已过期，移除隔离记录并返回 ErrVotingClosed 或 ErrArticleNotFound
+func (r ArticleRepo) ReviewVote(ctx context.Context, articleID, user string, accept bool) error {
+	quarantineKey := common.QuarantinedVotesPre + articleID
+
+	value, err := r.client.HGet(ctx, quarantineKey, user).Result()
+	if err == redis.Nil {
+		return ErrVoteNotQuarantined
+	}
+	if err != nil {
+		return err
+	}
+	var expired error
+	if accept {
+		var vote QuarantinedVote
+		if err := json.Unmarshal([]byte(value), &vote); err != nil {
+			return err
+		}
+		err := r.applyVote(ctx, articleID, user, vote.Up)
+		if err == ErrVotingClosed || err == ErrArticleNotFound {
+			expired = err
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if err := r.removeQuarantined(ctx, articleID, user); err != nil {
+		return err
+	}
+	return expired
+}
+
+// removeQuarantined 移除用户被隔离的投票，并减少文章的待审核投票数
+func (r ArticleRepo) removeQuarantined(ctx context.Context, articleID, user string) error {
+	quarantineKey := common.QuarantinedVotesPre + articleID
+	return r.client.Watch(ctx, func(tx *redis.Tx) error {
+		// 已被并发的审核移除
+		if !tx.HExists(ctx, quarantineKey, user).Val() {
+			return nil
+		}
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HDel(ctx, quarantineKey, user)
+			pipe.ZIncrBy(ctx, common.FlaggedArticles, -1, articleID)
+			pipe.ZRemRangeByScore(ctx, common.FlaggedArticles, "-inf", "0")
+			return nil
+		})
+		return err
+	}, quarantineKey)
+}
+
+// removeFraudRecords 在流水线中删除文章的投票来源和隔离记录
+func (r ArticleRepo) removeFraudRecords(ctx context.Context, pipe redis.Pipeliner, articleID string) {
+	pipe.Del(ctx, common.VoteSourcesPre+articleID, common.QuarantinedVotesPre+articleID)
+	pipe.ZRem(ctx, common.FlaggedArticles, articleID)
+}
@@ -0,0 +1,87 @@
+package chapter01
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"redis-practice/common"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+// leaderboardWindows 滚动窗口包含的小时数
+var leaderboardWindows = map[string]int64{
+	common.LeaderboardDay:  24,
+	common.LeaderboardWeek: 24 * 7,
+}
+
+// leaderboardRetention 每小时排行榜的保留秒数，覆盖最长的滚动窗口
+const leaderboardRetention = 24*7*3600 + 3600
+
+// leaderboardBucket 返回 ts 所在小时的排行榜 key
+func leaderboardBucket(ts int64) string {
+	return common.LeaderboardPre + strconv.FormatInt(ts-ts%3600, 10)
+}
+
+// leaderboardBuckets 返回截至 now 的最近 hours 个小时的排行榜 key
+func leaderboardBuckets(now, hours int64) []string {
+	keys := make([]string, 0, hours)
+	for i := int64(0); i < hours; i++ {
+		keys = append(keys, leaderboardBucket(now-i*3600))
+	}
+	return keys
+}
+
+// recordLeaderboardVote 将投票计入当前小时的排行榜，过期时间保证旧的小时排行榜被自动清理
+func (r ArticleRepo) recordLeaderboardVote(ctx context.Context, articleID string, delta int64) {
+	now := time.Now().Unix()
+	key := leaderboardBucket(now)
+
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZIncrBy(ctx, key, float64(delta), articleID)
+		pipe.ExpireAt(ctx, key, time.Unix(now-now%3600+leaderboardRetention, 0))
+		return nil
+	})
+	if err != nil {
+		logrus.Errorf("record article %s leaderboard vote failed, err: %v", articleID, err)
+	}
+}
+
+// GetLeaderboard 分页获取滚动窗口内净得票最多的文章，window 为 common.LeaderboardDay 或 common.LeaderboardWeek
+func (r ArticleRepo) GetLeaderboard(ctx context.Context, window string, page int64) []map[string]string {
+	hours, ok := leaderboardWindows[window]
+	if !ok {
+		hours, window = leaderboardWindows[common.LeaderboardDay], common.LeaderboardDay
+	}
+	key := common.LeaderboardWindowPre + window
+
+	// 缓存不存在时才合并每小时排行榜，并设置较短的过期时间
+	if r.client.Exists(ctx, key).Val() == 0 {
+		_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.ZUnionStore(ctx, key, &redis.ZStore{
+				Keys:      leaderboardBuckets(time.Now().Unix(), hours),
+				Aggregate: "SUM",
+			})
+			pipe.Expire(ctx, key, common.LeaderboardCacheSeconds*time.Second)
+			return nil
+		})
+		if err != nil {
+			logrus.Error("zunionstore leaderboard failed, err: ", err)
+			return []map[string]string{}
+		}
+	}
+
+	return r.getArticlesByKey(ctx, key, page)
+}
+
+// removeFromLeaderboards 在流水线中将文章从保留期内的所有排行榜中移除
+func (r ArticleRepo) removeFromLeaderboards(ctx context.Context, pipe redis.Pipeliner, articleID string) {
+	for window := range leaderboardWindows {
+		pipe.ZRem(ctx, common.LeaderboardWindowPre+window, articleID)
+	}
+	for _, key := range leaderboardBuckets(time.Now().Unix(), leaderboardRetention/3600) {
+		pipe.ZRem(ctx, key, articleID)
+	}
+}
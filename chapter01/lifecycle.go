@@ -0,0 +1,182 @@
+package chapter01
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"redis-practice/common"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+// ArchivedArticle 归档后的文章，保存文章哈希、最终得分、所属分组和所有评论哈希
+type ArchivedArticle struct {
+	Article  map[string]string   `json:"article"`
+	Score    float64             `json:"score"`
+	Groups   []string            `json:"groups,omitempty"`
+	Comments []map[string]string `json:"comments,omitempty"`
+}
+
+// EditArticle 修改文章的标题和链接，为空的字段保持不变
+func (r ArticleRepo) EditArticle(ctx context.Context, articleID, title, link string) error {
+	fields := make(map[string]any, 2)
+	if title != "" {
+		fields["title"] = title
+	}
+	if link != "" {
+		fields["link"] = link
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	hashKey := common.ArticleHashSetPre + articleID
+	// 监视文章哈希，避免与删除并发时重新创建出不完整的文章
+	return r.client.Watch(ctx, func(tx *redis.Tx) error {
+		if tx.Exists(ctx, hashKey).Val() == 0 {
+			return ErrArticleNotFound
+		}
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, hashKey, fields)
+			return nil
+		})
+		return err
+	}, hashKey)
+}
+
+// DeleteArticle 删除文章及其在 score、time、投票集合、所有分组中的记录和所有评论
+func (r ArticleRepo) DeleteArticle(ctx context.Context, articleID string) error {
+	hashKey := common.ArticleHashSetPre + articleID
+	groupsKey := common.ArticleGroupsPre + articleID
+	commentsKey := common.ArticleCommentsPre + articleID
+
+	return r.client.Watch(ctx, func(tx *redis.Tx) error {
+		if tx.Exists(ctx, hashKey).Val() == 0 {
+			return ErrArticleNotFound
+		}
+		groups := tx.SMembers(ctx, groupsKey).Val()
+		comments := tx.SMembers(ctx, commentsKey).Val()
+
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			r.removeArticle(ctx, pipe, articleID, groups)
+			r.removeComments(ctx, pipe, articleID, comments)
+			addEvent(ctx, pipe, EventDeleted, articleID, "")
+			return nil
+		})
+		return err
+	}, hashKey, groupsKey, commentsKey)
+}
+
+// GetArchivedArticle 获取已归档的文章
+func (r ArticleRepo) GetArchivedArticle(ctx context.Context, articleID string) (*ArchivedArticle, error) {
+	data, err := r.client.HGet(ctx, common.ArticleArchive, articleID).Bytes()
+	if err == redis.Nil {
+		return nil, ErrArticleNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	archived := &ArchivedArticle{}
+	if err := json.Unmarshal(data, archived); err != nil {
+		return nil, err
+	}
+	return archived, nil
+}
+
+// ArchiveExpired 定期将投票已截止的文章移入归档哈希，使在线的有序集合保持精简，直到 ctx 取消
+func (r ArticleRepo) ArchiveExpired(ctx context.Context) error {
+	for {
+		// 有待归档的文章时立即处理下一批，否则休眠再重新检查
+		if n := r.archiveBatch(ctx, common.ArchiveBatchSize); n < common.ArchiveBatchSize {
+			if err := common.SleepContext(ctx, 60*time.Second); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// archiveBatch 归档最多 limit 篇投票已截止的文章，返回归档的文章数
+func (r ArticleRepo) archiveBatch(ctx context.Context, limit int64) int64 {
+	cutoff := time.Now().Unix() - common.OneWeekInSeconds
+	ids := r.client.ZRangeByScore(ctx, common.Time, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(cutoff, 10),
+		Count: limit,
+	}).Val()
+
+	var archived int64
+	for _, articleID := range ids {
+		if err := r.archiveArticle(ctx, articleID); err != nil {
+			logrus.Errorf("archive article %s failed, err: %v", articleID, err)
+			continue
+		}
+		archived++
+	}
+	return archived
+}
+
+func (r ArticleRepo) archiveArticle(ctx context.Context, articleID string) error {
+	hashKey := common.ArticleHashSetPre + articleID
+	groupsKey := common.ArticleGroupsPre + articleID
+	commentsKey := common.ArticleCommentsPre + articleID
+
+	return r.client.Watch(ctx, func(tx *redis.Tx) error {
+		article := tx.HGetAll(ctx, hashKey).Val()
+		groups := tx.SMembers(ctx, groupsKey).Val()
+		commentIDs := tx.SMembers(ctx, commentsKey).Val()
+
+		var data []byte
+		if len(article) != 0 {
+			comments := make([]map[string]string, 0, len(commentIDs))
+			for _, commentID := range commentIDs {
+				if comment := tx.HGetAll(ctx, common.CommentHashSetPre+commentID).Val(); len(comment) != 0 {
+					comments = append(comments, comment)
+				}
+			}
+			var err error
+			data, err = json.Marshal(&ArchivedArticle{
+				Article:  article,
+				Score:    tx.ZScore(ctx, common.Score, articleID).Val(),
+				Groups:   groups,
+				Comments: comments,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			// 文章哈希已不存在时只清理残留的索引
+			if data != nil {
+				pipe.HSet(ctx, common.ArticleArchive, articleID, data)
+			}
+			r.removeArticle(ctx, pipe, articleID, groups)
+			r.removeComments(ctx, pipe, articleID, commentIDs)
+			return nil
+		})
+		return err
+	}, hashKey, groupsKey, commentsKey)
+}
+
+// removeArticle 在流水线中删除文章的所有在线数据
+func (r ArticleRepo) removeArticle(ctx context.Context, pipe redis.Pipeliner, articleID string, groups []string) {
+	for _, group := range groups {
+		pipe.SRem(ctx, common.GroupPre+group, articleID)
+	}
+	for _, ranker := range r.rankers() {
+		pipe.ZRem(ctx, ranker.Name(), articleID)
+	}
+	pipe.ZRem(ctx, common.Time, articleID)
+	r.removeFromLeaderboards(ctx, pipe, articleID)
+	r.removeFraudRecords(ctx, pipe, articleID)
+	pipe.Del(ctx,
+		common.ArticleHashSetPre+articleID,
+		common.VotedSetPre+articleID,
+		common.DownVotedSetPre+articleID,
+		common.ArticleGroupsPre+articleID,
+	)
+}
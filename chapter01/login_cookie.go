@@ -6,7 +6,6 @@ import (
 	"encoding/hex"
 	"net/url"
 	"strings"
-	"sync/atomic"
 	"time"
 
 	"redis-practice/common"
@@ -48,36 +47,36 @@ func (c *Cache) UpdateTokenBehavior(ctx context.Context, token, user, item strin
 	}
 }
 
-// CleanSession 清理会话
-func (c *Cache) CleanSession(ctx context.Context) {
-	// 如果退出了就不再执行
-	for !common.QUIT {
+// CleanSession 清理会话，直到 ctx 取消
+func (c *Cache) CleanSession(ctx context.Context) error {
+	for {
 		// 检查是否到达限制，如果未达限制则休眠再重新检查
 		size := c.Client.ZCard(ctx, common.Recent).Val()
-		if size <= common.LIMIT {
-			time.Sleep(1 * time.Second)
+		if size <= common.SessionMax {
+			if err := common.SleepContext(ctx, time.Second); err != nil {
+				return err
+			}
 			continue
 		}
 		// 一次最多删除一百条
-		endIndex := common.LIMIT
-		if size < endIndex {
-			endIndex = size
+		endIndex := size - common.SessionMax
+		if endIndex > common.SessionEvictBatch {
+			endIndex = common.SessionEvictBatch
 		}
 		// 在最近访问中找出最早的一部分 token 记录
 		tokens := c.Client.ZRange(ctx, common.Recent, 0, endIndex-1).Val()
 
+		members := make([]any, 0, len(tokens))
 		sessionKeys := make([]string, 0, len(tokens))
 		for _, token := range tokens {
+			members = append(members, token)
 			sessionKeys = append(sessionKeys, common.ViewedPre+token)
 		}
 
 		c.Client.HDel(ctx, common.LoginHash, tokens...)
-		c.Client.ZRem(ctx, common.Recent, tokens)
+		c.Client.ZRem(ctx, common.Recent, members...)
 		c.Client.Del(ctx, sessionKeys...)
 	}
-
-	defer atomic.AddInt32(&common.FLAG, -1)
-
 }
 
 // AddToCart 增加商品到购物车
@@ -91,38 +90,38 @@ func (c *Cache) AddToCart(ctx context.Context, session, item string, count int)
 	}
 }
 
-// CleanFullSession 清理包括购物车在内的会话
-func (c *Cache) CleanFullSession(ctx context.Context) {
-	// 如果退出了就不再执行
-	for !common.QUIT {
+// CleanFullSession 清理包括购物车在内的会话，直到 ctx 取消
+func (c *Cache) CleanFullSession(ctx context.Context) error {
+	for {
 		// 检查是否到达限制，如果未达限制则休眠再重新检查
 		size := c.Client.ZCard(ctx, common.Recent).Val()
-		if size <= common.LIMIT {
-			time.Sleep(1 * time.Second)
+		if size <= common.SessionMax {
+			if err := common.SleepContext(ctx, time.Second); err != nil {
+				return err
+			}
 			continue
 		}
 		// 一次最多删除一百条
-		endIndex := common.LIMIT
-		if size < endIndex {
-			endIndex = size
+		endIndex := size - common.SessionMax
+		if endIndex > common.SessionEvictBatch {
+			endIndex = common.SessionEvictBatch
 		}
 		// 在最近访问中找出最早的一部分 token 记录
 		tokens := c.Client.ZRange(ctx, common.Recent, 0, endIndex-1).Val()
 
+		members := make([]any, 0, len(tokens))
 		sessionKeys := make([]string, 0, len(tokens))
 		for _, token := range tokens {
+			members = append(members, token)
 			sessionKeys = append(sessionKeys, common.ViewedPre+token)
 			sessionKeys = append(sessionKeys, common.CartPre+token)
 
 		}
 
 		c.Client.HDel(ctx, common.LoginHash, tokens...)
-		c.Client.ZRem(ctx, common.Recent, tokens)
+		c.Client.ZRem(ctx, common.Recent, members...)
 		c.Client.Del(ctx, sessionKeys...)
-
 	}
-
-	defer atomic.AddInt32(&common.FLAG, -1)
 }
 
 // CacheRequest 带缓存的请求处理
@@ -183,46 +182,3 @@ func hashRequest(req string) string {
 	res := hash.Sum(nil)
 	return hex.EncodeToString(res)
 }
-
-// 调度有序集合和延迟集合缓存
-func (c *Client) ScheduleRowCache(rowID string, delay int) {
-	c.Client.ZAdd(common.Schedule, redis.Z {
-		Score: float64(time.Now().Unix() + delay),
-		Member: rowID,
-	})
-	c.Client.ZAdd(common.Schedule, redis.Z {
-		Score: float64(delay),
-		Member: rowID,
-	})
-}
-
-func (c *Client) CacheRows() {
-	for !common.QUIT {
-		next := c.Client.ZRangeWithScores(common.Schedule, 0, 0).Val()
-		now := time.Now().Unix()
-		if len(next) == 0 || next[0].Score > float64(now) {
-			time.Sleep(50 * time.Millisecond)
-			continue
-		}
-
-		rowID := next[0].Member
-		delay := c.Client.ZScore(common.Delay, rowID).Val()
-		if delay <= 0 {
-			c.Client.ZRem(common.Schedule, rowID)
-			c.Client.ZRem(common.Delay, rowID)
-			c.Client.Del(common.RowCachePre + rowID)
-			continue
-		}
-
-		row := repository.Get(rowId)
-		r.Conn.ZAdd("schedule:", &redis.Z{Member: rowId, Score: float64(now) + delay})
-		jsonRow, err := json.Marshal(row)
-		if err != nil {
-			log.Fatalf("marshal json failed, data is: %v, err is: %v\n", row, err)
-		}
-		r.Conn.Set("inv:"+rowId, jsonRow, 0)
-
-	}
-	defer atomic.AddInt32(&common.FLAG, -1)	
-}
-
@@ -0,0 +1,176 @@
+package chapter01
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"time"
+
+	"redis-practice/common"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+// VoteStats 计算排名所需的文章投票统计
+type VoteStats struct {
+	// Posted 发布时间戳
+	Posted int64
+	// Up 赞成票数
+	Up int64
+	// Down 反对票数
+	Down int64
+}
+
+// Ranker 文章排名策略，每种排名维护一个独立的有序集合
+type Ranker interface {
+	// Name 排名名称，同时作为有序集合的 key 和 GetArticles 的 order 参数
+	Name() string
+	// Rank 根据投票统计计算文章在 now 时刻的得分
+	Rank(stats VoteStats, now int64) float64
+}
+
+// DefaultRankers 默认启用的排名策略
+func DefaultRankers() []Ranker {
+	return []Ranker{ScoreRanker{}, HotRanker{}, VotesRanker{}, BestRanker{}}
+}
+
+// ScoreRanker 发布时间加上每票 common.VotedScore 分
+type ScoreRanker struct{}
+
+func (ScoreRanker) Name() string { return common.Score }
+
+func (ScoreRanker) Rank(stats VoteStats, _ int64) float64 {
+	return float64(stats.Posted + (stats.Up-stats.Down)*common.VotedScore)
+}
+
+// HotRanker Hacker News 风格的时间衰减排名：(票数) / (发布小时数 + 2) ^ 1.8
+type HotRanker struct{}
+
+func (HotRanker) Name() string { return common.Hot }
+
+func (HotRanker) Rank(stats VoteStats, now int64) float64 {
+	hours := float64(now-stats.Posted) / 3600
+	if hours < 0 {
+		hours = 0
+	}
+	return float64(stats.Up-stats.Down) / math.Pow(hours+2, 1.8)
+}
+
+// VotesRanker 净票数排名
+type VotesRanker struct{}
+
+func (VotesRanker) Name() string { return common.Votes }
+
+func (VotesRanker) Rank(stats VoteStats, _ int64) float64 {
+	return float64(stats.Up - stats.Down)
+}
+
+// BestRanker 赞成率 95% 置信区间的 Wilson 下界排名
+type BestRanker struct{}
+
+func (BestRanker) Name() string { return common.Best }
+
+func (BestRanker) Rank(stats VoteStats, _ int64) float64 {
+	n := float64(stats.Up + stats.Down)
+	if n == 0 {
+		return 0
+	}
+	const z = 1.96
+	p := float64(stats.Up) / n
+	return (p + z*z/(2*n) - z*math.Sqrt((p*(1-p)+z*z/(4*n))/n)) / (1 + z*z/n)
+}
+
+func (r ArticleRepo) rankers() []Ranker {
+	if r.Rankers != nil {
+		return r.Rankers
+	}
+	return DefaultRankers()
+}
+
+// orderKey 返回 order 对应的有序集合，未知的排序方式使用 score
+func (r ArticleRepo) orderKey(order string) string {
+	if order == common.Time {
+		return order
+	}
+	for _, ranker := range r.rankers() {
+		if ranker.Name() == order {
+			return order
+		}
+	}
+	return common.Score
+}
+
+// addRanks 在流水线中写入文章在所有排名中的得分
+func (r ArticleRepo) addRanks(ctx context.Context, pipe redis.Pipeliner, articleID string, stats VoteStats, now int64) {
+	for _, ranker := range r.rankers() {
+		pipe.ZAdd(ctx, ranker.Name(), redis.Z{
+			Score:  ranker.Rank(stats, now),
+			Member: articleID,
+		})
+	}
+}
+
+// updateRanks 根据文章哈希中的投票统计重新计算所有排名，
+// 监视文章哈希以保证并发投票时写入的是最新统计，文章哈希被并发修改时重试
+func (r ArticleRepo) updateRanks(ctx context.Context, articleID string) error {
+	var err error
+	for i := 0; i < common.UpdateRanksRetries; i++ {
+		if err = r.tryUpdateRanks(ctx, articleID); err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return err
+}
+
+func (r ArticleRepo) tryUpdateRanks(ctx context.Context, articleID string) error {
+	hashKey := common.ArticleHashSetPre + articleID
+
+	return r.client.Watch(ctx, func(tx *redis.Tx) error {
+		values, err := tx.HMGet(ctx, hashKey, "time", "upvotes", "downvotes").Result()
+		if err != nil {
+			return err
+		}
+		if values[0] == nil {
+			return ErrArticleNotFound
+		}
+
+		stats := VoteStats{
+			Posted: parseInt(values[0]),
+			Up:     parseInt(values[1]),
+			Down:   parseInt(values[2]),
+		}
+		now := time.Now().Unix()
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			r.addRanks(ctx, pipe, articleID, stats, now)
+			return nil
+		})
+		return err
+	}, hashKey)
+}
+
+// RefreshRanks 定期重新计算仍在投票窗口内的文章排名，使随时间衰减的排名保持准确，直到 ctx 取消
+func (r ArticleRepo) RefreshRanks(ctx context.Context) error {
+	for {
+		r.refreshRanks(ctx)
+		if err := common.SleepContext(ctx, common.RefreshRanksSeconds*time.Second); err != nil {
+			return err
+		}
+	}
+}
+
+func (r ArticleRepo) refreshRanks(ctx context.Context) {
+	min := strconv.FormatInt(time.Now().Unix()-common.OneWeekInSeconds, 10)
+	for _, articleID := range r.client.ZRangeByScore(ctx, common.Time, &redis.ZRangeBy{Min: min, Max: "+inf"}).Val() {
+		if err := r.updateRanks(ctx, articleID); err != nil && err != ErrArticleNotFound {
+			logrus.Errorf("refresh article %s ranks failed, err: %v", articleID, err)
+		}
+	}
+}
+
+func parseInt(v any) int64 {
+	s, _ := v.(string)
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return n
+}
@@ -0,0 +1,308 @@
+package chapter01
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"redis-practice/common"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+// similarityScript 在服务端计算种子文章与每篇候选文章投票集合的大小及交集大小，避免传输交集成员，
+// 作者在发文时被加入投票集合以防止自投，计算时排除各文章的作者，SINTERCARD 需要 7.0
+//
+// KEYS: 种子文章投票集合, 候选文章投票集合...
+// ARGV: 种子文章作者, 候选文章作者...
+// 返回: {种子集合大小, 候选 1 集合大小, 交集 1 大小, 候选 2 集合大小, 交集 2 大小, ...}
+var similarityScript = redis.NewScript(`
+local function card(key, poster)
+	local n = redis.call('SCARD', key)
+	if poster ~= '' and redis.call('SISMEMBER', key, poster) == 1 then
+		n = n - 1
+	end
+	return n
+end
+
+local res = {card(KEYS[1], ARGV[1])}
+for i = 2, #KEYS do
+	local n = 0
+	for _, member in ipairs(redis.call('SINTER', KEYS[1], KEYS[i])) do
+		if member ~= ARGV[1] and member ~= ARGV[i] then
+			n = n + 1
+		end
+	end
+	res[#res + 1] = card(KEYS[i], ARGV[i])
+	res[#res + 1] = n
+end
+return res
+`)
+
+// recordUserVote 维护用户投过赞成票的文章索引和最近投票用户
+func (r ArticleRepo) recordUserVote(ctx context.Context, articleID, user string, up bool) {
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		if up {
+			pipe.SAdd(ctx, common.UserVotedPre+user, articleID)
+		} else {
+			pipe.SRem(ctx, common.UserVotedPre+user, articleID)
+		}
+		pipe.ZAdd(ctx, common.RecentVoters, redis.Z{Score: float64(time.Now().Unix()), Member: user})
+		return nil
+	})
+	if err != nil {
+		logrus.Errorf("record user %s vote failed, err: %v", user, err)
+	}
+}
+
+// RecommendFor 返回为用户推荐的至多 n 篇文章，不含用户已投过票的文章，推荐结果不存在时即时计算
+func (r ArticleRepo) RecommendFor(ctx context.Context, user string, n int64) ([]map[string]string, error) {
+	key := common.RecommendationsPre + user
+	if r.client.Exists(ctx, key).Val() == 0 {
+		if err := r.refreshRecommendations(ctx, user); err != nil {
+			return nil, err
+		}
+	}
+
+	// 排除分值为 0 的 common.RecommendNone 占位成员
+	candidates, err := r.client.ZRevRangeByScore(ctx, key, &redis.ZRangeBy{Min: "(0", Max: "+inf"}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	// 推荐结果计算后用户可能又投了票，读取时再次排除
+	upCmds := make([]*redis.BoolCmd, 0, len(candidates))
+	downCmds := make([]*redis.BoolCmd, 0, len(candidates))
+	_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, articleID := range candidates {
+			upCmds = append(upCmds, pipe.SIsMember(ctx, common.VotedSetPre+articleID, user))
+			downCmds = append(downCmds, pipe.SIsMember(ctx, common.DownVotedSetPre+articleID, user))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, n)
+	for i, articleID := range candidates {
+		if int64(len(ids)) == n {
+			break
+		}
+		if !upCmds[i].Val() && !downCmds[i].Val() {
+			ids = append(ids, articleID)
+		}
+	}
+	return r.getArticlesByIDs(ctx, ids), nil
+}
+
+// RefreshRecommendations 定期为最近一周投过票的用户重新计算推荐，直到 ctx 取消
+func (r ArticleRepo) RefreshRecommendations(ctx context.Context) error {
+	for {
+		min := strconv.FormatInt(time.Now().Unix()-common.OneWeekInSeconds, 10)
+		r.client.ZRemRangeByScore(ctx, common.RecentVoters, "-inf", "("+min)
+
+		for _, user := range r.client.ZRange(ctx, common.RecentVoters, 0, -1).Val() {
+			if err := r.refreshRecommendations(ctx, user); err != nil {
+				logrus.Errorf("refresh user %s recommendations failed, err: %v", user, err)
+			}
+		}
+		if err := common.SleepContext(ctx, common.RefreshRecommendationsSeconds*time.Second); err != nil {
+			return err
+		}
+	}
+}
+
+// refreshRecommendations 以“投了这篇文章的用户也投了”计算用户的推荐：
+// 从用户投过赞成票的文章出发，抽样这些文章的投票用户，以他们投过的其他文章为候选，
+// 候选文章的得分为其与用户各篇文章投票集合的余弦相似度之和，
+// 只计算被抽样用户投票最多的 common.RecommendCandidates 篇候选文章
+func (r ArticleRepo) refreshRecommendations(ctx context.Context, user string) error {
+	seeds, err := r.liveUserVotes(ctx, user)
+	if err != nil {
+		return err
+	}
+	if len(seeds) == 0 {
+		return r.storeRecommendations(ctx, user, nil)
+	}
+	voted := make(map[string]bool, len(seeds))
+	for _, articleID := range seeds {
+		voted[articleID] = true
+	}
+	if len(seeds) > common.RecommendSeeds {
+		seeds = seeds[:common.RecommendSeeds]
+	}
+
+	// 抽样投票用户，收集他们投过的其他文章作为候选
+	voterCmds := make([]*redis.StringSliceCmd, 0, len(seeds))
+	_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, articleID := range seeds {
+			voterCmds = append(voterCmds, pipe.SRandMemberN(ctx, common.VotedSetPre+articleID, common.RecommendSampleVoters))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	voters := make(map[string]bool)
+	for _, cmd := range voterCmds {
+		for _, voter := range cmd.Val() {
+			if voter != user {
+				voters[voter] = true
+			}
+		}
+	}
+
+	candidateCmds := make([]*redis.StringSliceCmd, 0, len(voters))
+	_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for voter := range voters {
+			candidateCmds = append(candidateCmds, pipe.SMembers(ctx, common.UserVotedPre+voter))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	counts := make(map[string]int)
+	for _, cmd := range candidateCmds {
+		for _, articleID := range cmd.Val() {
+			if !voted[articleID] {
+				counts[articleID]++
+			}
+		}
+	}
+	candidates := make([]string, 0, len(counts))
+	for articleID := range counts {
+		candidates = append(candidates, articleID)
+	}
+	sort.Slice(candidates, func(i, j int) bool { return counts[candidates[i]] > counts[candidates[j]] })
+	if len(candidates) > common.RecommendCandidates {
+		candidates = candidates[:common.RecommendCandidates]
+	}
+
+	scores, err := r.similarities(ctx, seeds, candidates)
+	if err != nil {
+		return err
+	}
+	sort.Slice(candidates, func(i, j int) bool { return scores[candidates[i]] > scores[candidates[j]] })
+	if len(candidates) > common.RecommendMax {
+		candidates = candidates[:common.RecommendMax]
+	}
+
+	members := make([]redis.Z, 0, len(candidates))
+	for _, articleID := range candidates {
+		if scores[articleID] > 0 {
+			members = append(members, redis.Z{Score: scores[articleID], Member: articleID})
+		}
+	}
+	return r.storeRecommendations(ctx, user, members)
+}
+
+// storeRecommendations 替换用户的推荐结果，没有可推荐的文章时写入 common.RecommendNone 占位
+func (r ArticleRepo) storeRecommendations(ctx context.Context, user string, members []redis.Z) error {
+	if len(members) == 0 {
+		members = []redis.Z{{Score: 0, Member: common.RecommendNone}}
+	}
+
+	key := common.RecommendationsPre + user
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		pipe.ZAdd(ctx, key, members...)
+		pipe.Expire(ctx, key, common.RecommendationSeconds*time.Second)
+		return nil
+	})
+	return err
+}
+
+// liveUserVotes 返回用户投过赞成票且仍在线的文章，并清理索引中已删除或归档的文章
+func (r ArticleRepo) liveUserVotes(ctx context.Context, user string) ([]string, error) {
+	key := common.UserVotedPre + user
+	articles, err := r.client.SMembers(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	cmds := make([]*redis.FloatCmd, 0, len(articles))
+	_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, articleID := range articles {
+			cmds = append(cmds, pipe.ZScore(ctx, common.Time, articleID))
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	live := make([]string, 0, len(articles))
+	stale := make([]any, 0)
+	for i, articleID := range articles {
+		if cmds[i].Err() == redis.Nil {
+			stale = append(stale, articleID)
+			continue
+		}
+		live = append(live, articleID)
+	}
+	if len(stale) != 0 {
+		r.client.SRem(ctx, key, stale...)
+	}
+	return live, nil
+}
+
+// similarities 计算每篇候选文章与各篇种子文章投票集合的余弦相似度之和，每篇种子文章执行一次脚本
+func (r ArticleRepo) similarities(ctx context.Context, seeds, candidates []string) (map[string]float64, error) {
+	scores := make(map[string]float64, len(candidates))
+	if len(candidates) == 0 {
+		return scores, nil
+	}
+
+	articles := append(append([]string{}, seeds...), candidates...)
+	posterCmds := make(map[string]*redis.StringCmd, len(articles))
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, articleID := range articles {
+			posterCmds[articleID] = pipe.HGet(ctx, common.ArticleHashSetPre+articleID, "poster")
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	candidateKeys := make([]string, 0, len(candidates))
+	candidatePosters := make([]any, 0, len(candidates))
+	for _, candidate := range candidates {
+		candidateKeys = append(candidateKeys, common.VotedSetPre+candidate)
+		candidatePosters = append(candidatePosters, posterCmds[candidate].Val())
+	}
+
+	cmds := make([]*redis.Cmd, 0, len(seeds))
+	_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, seed := range seeds {
+			keys := append([]string{common.VotedSetPre + seed}, candidateKeys...)
+			args := append([]any{posterCmds[seed].Val()}, candidatePosters...)
+			cmds = append(cmds, similarityScript.Eval(ctx, pipe, keys, args...))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, cmd := range cmds {
+		res, err := cmd.Int64Slice()
+		if err != nil {
+			return nil, err
+		}
+		seedCard := res[0]
+		for i, candidate := range candidates {
+			candidateCard, inter := res[1+2*i], res[2+2*i]
+			if inter == 0 || seedCard == 0 || candidateCard == 0 {
+				continue
+			}
+			scores[candidate] += float64(inter) / math.Sqrt(float64(seedCard*candidateCard))
+		}
+	}
+	return scores, nil
+}
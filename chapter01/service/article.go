@@ -2,10 +2,41 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"redis-practice/chapter01"
 	"redis-practice/chapter01/dto"
+	"redis-practice/common"
+)
+
+// MaxTitleLength 文章标题的最大字符数
+const MaxTitleLength = 200
+
+var (
+	// ErrArticleNotFound 文章不存在
+	ErrArticleNotFound = chapter01.ErrArticleNotFound
+	// ErrVotingClosed 文章已超过投票截止时间
+	ErrVotingClosed = chapter01.ErrVotingClosed
+	// ErrVoteQuarantined 投票来源可疑，已隔离等待审核
+	ErrVoteQuarantined = chapter01.ErrVoteQuarantined
+	// ErrVoteNotQuarantined 没有该用户待审核的投票
+	ErrVoteNotQuarantined = chapter01.ErrVoteNotQuarantined
+	// ErrRateLimited 发文或投票过于频繁，可通过 errors.As 取得 *common.RateLimitError 中的重试时间
+	ErrRateLimited = common.ErrRateLimited
+	// ErrEmptyAuthor 作者或投票用户为空
+	ErrEmptyAuthor = errors.New("author must not be empty")
+	// ErrInvalidTitle 标题为空或过长
+	ErrInvalidTitle = fmt.Errorf("title must be 1 to %d characters", MaxTitleLength)
+	// ErrInvalidLink 链接不是合法的 http(s) URL
+	ErrInvalidLink = errors.New("link must be an absolute http or https url")
+	// ErrInvalidArticleID 文章 id 不是正整数
+	ErrInvalidArticleID = errors.New("article id must be a positive integer")
 )
 
 type ArticleService struct {
@@ -19,41 +50,208 @@ func NewArticleService(repo *chapter01.ArticleRepo) *ArticleService {
 
 // PostArticle handles the business logic for posting a new article.
 func (s *ArticleService) PostArticle(ctx context.Context, user, title, link string) (string, error) {
-	// 这里可以添加业务逻辑，比如验证输入数据的有效性
+	user, title, link = strings.TrimSpace(user), strings.TrimSpace(title), strings.TrimSpace(link)
+	if err := validateUser(user); err != nil {
+		return "", err
+	}
+	if err := validateTitle(title); err != nil {
+		return "", err
+	}
+	if err := validateLink(link); err != nil {
+		return "", err
+	}
 
 	// 调用DAO层发布文章
-	articleID := s.repo.PostArticle(ctx, user, title, link)
-	if articleID == "" {
+	articleID, err := s.repo.PostArticle(ctx, user, title, link)
+	if err != nil {
+		return "", err
+	}
+	if articleID == "" || articleID == "0" {
 		return "", fmt.Errorf("failed to post article")
 	}
 	return articleID, nil
 }
 
-// VoteArticle handles the logic for voting on an article.
-func (s *ArticleService) VoteArticle(ctx context.Context, articleID, userID string) error {
-	// 可以在这里添加业务逻辑，比如检查用户是否已经投票
+// EditArticle updates the title and/or link of an article, empty values are left unchanged.
+func (s *ArticleService) EditArticle(ctx context.Context, articleID, title, link string) error {
+	title, link = strings.TrimSpace(title), strings.TrimSpace(link)
+	if err := validateArticleID(articleID); err != nil {
+		return err
+	}
+	if title != "" {
+		if err := validateTitle(title); err != nil {
+			return err
+		}
+	}
+	if link != "" {
+		if err := validateLink(link); err != nil {
+			return err
+		}
+	}
+
+	return s.repo.EditArticle(ctx, articleID, title, link)
+}
+
+// DeleteArticle removes an article and everything indexing it.
+func (s *ArticleService) DeleteArticle(ctx context.Context, articleID string) error {
+	if err := validateArticleID(articleID); err != nil {
+		return err
+	}
+	return s.repo.DeleteArticle(ctx, articleID)
+}
 
-	// 调用DAO层进行投票
-	s.repo.ArticleUpVote(ctx, "article:"+articleID, userID)
-	return nil
+// VoteArticle handles the logic for up-voting an article, source is used to detect vote fraud.
+func (s *ArticleService) VoteArticle(ctx context.Context, articleID, userID string, source chapter01.VoteSource) error {
+	if err := validateVote(articleID, userID); err != nil {
+		return err
+	}
+	return s.repo.ArticleVoteFrom(ctx, articleID, strings.TrimSpace(userID), true, source)
 }
 
-// GetArticles handles fetching articles with pagination and sorting.
-func (s *ArticleService) GetArticles(ctx context.Context) ([]dto.Article, error) {
-	// 调用DAO层获取文章列表
-	articlesData, err := s.repo.GetArticles(ctx)
+// DownVoteArticle handles the logic for down-voting an article, source is used to detect vote fraud.
+func (s *ArticleService) DownVoteArticle(ctx context.Context, articleID, userID string, source chapter01.VoteSource) error {
+	if err := validateVote(articleID, userID); err != nil {
+		return err
+	}
+	return s.repo.ArticleVoteFrom(ctx, articleID, strings.TrimSpace(userID), false, source)
+}
+
+// GetFlaggedArticles fetches the articles having quarantined votes.
+func (s *ArticleService) GetFlaggedArticles(ctx context.Context) ([]dto.Article, error) {
+	ids, err := s.repo.GetFlaggedArticles(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	articles := make([]dto.Article, 0, len(ids))
+	for _, articleID := range ids {
+		data, err := s.repo.GetArticle(ctx, articleID)
+		if err == ErrArticleNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		articles = append(articles, toArticle(data))
+	}
+	return articles, nil
+}
+
+// GetQuarantinedVotes fetches the votes of an article waiting for review.
+func (s *ArticleService) GetQuarantinedVotes(ctx context.Context, articleID string) ([]chapter01.QuarantinedVote, error) {
+	if err := validateArticleID(articleID); err != nil {
+		return nil, err
+	}
+	return s.repo.GetQuarantinedVotes(ctx, articleID)
+}
+
+// ReviewVote accepts or rejects a quarantined vote.
+func (s *ArticleService) ReviewVote(ctx context.Context, articleID, userID string, accept bool) error {
+	if err := validateVote(articleID, userID); err != nil {
+		return err
+	}
+	return s.repo.ReviewVote(ctx, articleID, strings.TrimSpace(userID), accept)
+}
+
+// GetArticle fetches a single article.
+func (s *ArticleService) GetArticle(ctx context.Context, articleID string) (*dto.Article, error) {
+	if err := validateArticleID(articleID); err != nil {
+		return nil, err
+	}
+
+	data, err := s.repo.GetArticle(ctx, articleID)
 	if err != nil {
 		return nil, err
 	}
-	// 转换数据到DTO对象，这里简单模拟转换过程
-	var articles []dto.Article
+	article := toArticle(data)
+	return &article, nil
+}
+
+// GetArticles handles fetching articles with pagination and sorting.
+func (s *ArticleService) GetArticles(ctx context.Context, page int64, order string) ([]dto.Article, error) {
+	// 调用DAO层获取文章列表
+	return toArticles(s.repo.GetArticles(ctx, page, order)), nil
+}
+
+// GetGroupArticles fetches the articles of a group with pagination and sorting.
+func (s *ArticleService) GetGroupArticles(ctx context.Context, group, order string, page int64) ([]dto.Article, error) {
+	return toArticles(s.repo.GetGroupArticle(ctx, group, order, page)), nil
+}
+
+// AddRemoveGroups adds an article to the groups in toAdd and removes it from the groups in toRemove.
+func (s *ArticleService) AddRemoveGroups(ctx context.Context, articleID string, toAdd, toRemove []string) error {
+	if err := validateArticleID(articleID); err != nil {
+		return err
+	}
+	// 文章不存在时不应创建分组记录
+	if _, err := s.repo.GetArticle(ctx, articleID); err != nil {
+		return err
+	}
+
+	s.repo.AddRemoveGroups(ctx, articleID, toAdd, toRemove)
+	return nil
+}
+
+func validateUser(user string) error {
+	if user == "" {
+		return ErrEmptyAuthor
+	}
+	return nil
+}
+
+func validateTitle(title string) error {
+	if n := utf8.RuneCountInString(title); n == 0 || n > MaxTitleLength {
+		return ErrInvalidTitle
+	}
+	return nil
+}
+
+func validateLink(link string) error {
+	u, err := url.ParseRequestURI(link)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ErrInvalidLink
+	}
+	return nil
+}
+
+func validateArticleID(articleID string) error {
+	if id, err := strconv.ParseInt(articleID, 10, 64); err != nil || id <= 0 {
+		return ErrInvalidArticleID
+	}
+	return nil
+}
+
+func validateVote(articleID, userID string) error {
+	if err := validateArticleID(articleID); err != nil {
+		return err
+	}
+	return validateUser(strings.TrimSpace(userID))
+}
+
+// toArticles 将文章哈希列表转换为 DTO 列表
+func toArticles(articlesData []map[string]string) []dto.Article {
+	articles := make([]dto.Article, 0, len(articlesData))
 	for _, data := range articlesData {
-		articles = append(articles, dto.Article{
-			Title: data["title"],
-			Link:  data["link"],
-			// 根据需要填充其他字段
-		})
+		articles = append(articles, toArticle(data))
 	}
+	return articles
+}
 
-	return articles, nil
+// toArticle 将文章哈希转换为 DTO
+func toArticle(data map[string]string) dto.Article {
+	id, _ := strconv.Atoi(data["id"])
+	votes, _ := strconv.Atoi(data["votes"])
+	comments, _ := strconv.Atoi(data["comments"])
+	posted, _ := strconv.ParseInt(data["time"], 10, 64)
+
+	return dto.Article{
+		ID:       id,
+		Title:    data["title"],
+		Author:   data["poster"],
+		Link:     data["link"],
+		PostTime: time.Unix(posted, 0),
+		Votes:    votes,
+		Comments: comments,
+		Group:    data["groups"],
+	}
 }
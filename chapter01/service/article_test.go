@@ -0,0 +1,42 @@
+package service
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	assert.Equal(t, ErrEmptyAuthor, validateUser(""))
+	assert.Nil(t, validateUser("hualulu"))
+
+	assert.Equal(t, ErrInvalidTitle, validateTitle(""))
+	assert.Equal(t, ErrInvalidTitle, validateTitle(strings.Repeat("长", MaxTitleLength+1)))
+	assert.Nil(t, validateTitle(strings.Repeat("长", MaxTitleLength)))
+
+	assert.Equal(t, ErrInvalidLink, validateLink("www.hualubang.com"))
+	assert.Equal(t, ErrInvalidLink, validateLink("ftp://www.hualubang.com/1"))
+	assert.Nil(t, validateLink("http://www.hualubang.com/1"))
+
+	assert.Equal(t, ErrInvalidArticleID, validateArticleID("article:1"))
+	assert.Nil(t, validateArticleID("1"))
+}
+
+func TestToArticle(t *testing.T) {
+	article := toArticle(map[string]string{
+		"id":     "1",
+		"title":  "hualubang up up",
+		"link":   "http://www.hualubang.com/1",
+		"poster": "hualulu",
+		"time":   "1700000000",
+		"votes":  "2",
+		"groups": "go,redis",
+	})
+
+	assert.Equal(t, 1, article.ID)
+	assert.Equal(t, "hualulu", article.Author)
+	assert.EqualValues(t, 1700000000, article.PostTime.Unix())
+	assert.Equal(t, 2, article.Votes)
+	assert.Equal(t, "go,redis", article.Group)
+}
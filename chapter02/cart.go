@@ -0,0 +1,146 @@
+package chapter02
+
+import (
+	"context"
+	"sort"
+	"strconv"
+
+	"redis-practice/common"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// CartLine 购物车中的一种商品，价格以分为单位
+type CartLine struct {
+	Item     string `json:"item"`
+	Quantity int64  `json:"quantity"`
+	Price    int64  `json:"price"`
+	Subtotal int64  `json:"subtotal"`
+	// Available 为 false 表示商品已下架，不计入总价
+	Available bool `json:"available"`
+}
+
+// Cart 购物车内容及按商品目录计算的总价
+type Cart struct {
+	Lines []CartLine `json:"lines"`
+	Total int64      `json:"total"`
+}
+
+// cartScript 设置或增加购物车中商品的数量，返回新的数量，-1 表示商品不在目录中，-2 表示超过最大数量
+//
+// KEYS: 购物车, 商品目录
+// ARGV: 商品, 数量, 是否为增量（1 为增量）, 最大数量
+var cartScript = redis.NewScript(`
+local quantity = tonumber(ARGV[2])
+if ARGV[3] == '1' then
+	quantity = quantity + tonumber(redis.call('HGET', KEYS[1], ARGV[1]) or '0')
+end
+if quantity <= 0 then
+	redis.call('HDEL', KEYS[1], ARGV[1])
+	return 0
+end
+if redis.call('HEXISTS', KEYS[2], ARGV[1]) == 0 then
+	return -1
+end
+if quantity > tonumber(ARGV[4]) then
+	return -2
+end
+redis.call('HSET', KEYS[1], ARGV[1], quantity)
+return quantity
+`)
+
+// SetPrice 将商品加入商品目录或修改其价格
+func (c *Cache) SetPrice(ctx context.Context, item string, price int64) error {
+	if price < 0 {
+		return ErrInvalidPrice
+	}
+	return c.Client.HSet(ctx, common.ProductCatalog, item, price).Err()
+}
+
+// RemoveProduct 将商品从商品目录中下架，已在购物车中的商品保留但不再计价
+func (c *Cache) RemoveProduct(ctx context.Context, item string) error {
+	return c.Client.HDel(ctx, common.ProductCatalog, item).Err()
+}
+
+// AddToCart 将购物车中商品的数量设置为 count，count <= 0 时移除该商品
+func (c *Cache) AddToCart(ctx context.Context, session, item string, count int64) error {
+	_, err := c.updateCart(ctx, session, item, count, false)
+	return err
+}
+
+// IncrCartItem 将购物车中商品的数量增加 delta，delta 可为负，数量减到 0 时移除该商品，返回新的数量
+func (c *Cache) IncrCartItem(ctx context.Context, session, item string, delta int64) (int64, error) {
+	return c.updateCart(ctx, session, item, delta, true)
+}
+
+func (c *Cache) updateCart(ctx context.Context, session, item string, quantity int64, incr bool) (int64, error) {
+	if item == "" {
+		return 0, ErrUnknownItem
+	}
+	flag := "0"
+	if incr {
+		flag = "1"
+	}
+
+	res, err := cartScript.Run(ctx, c.Client,
+		[]string{common.CartPre + session, common.ProductCatalog},
+		item, quantity, flag, common.CartMaxQuantity,
+	).Int64()
+	if err != nil {
+		return 0, err
+	}
+	switch res {
+	case -1:
+		return 0, ErrUnknownItem
+	case -2:
+		return 0, ErrQuantityExceeded
+	}
+	return res, nil
+}
+
+// RemoveFromCart 从购物车中移除商品
+func (c *Cache) RemoveFromCart(ctx context.Context, session, item string) error {
+	return c.Client.HDel(ctx, common.CartPre+session, item).Err()
+}
+
+// ClearCart 清空购物车
+func (c *Cache) ClearCart(ctx context.Context, session string) error {
+	return c.Client.Del(ctx, common.CartPre+session).Err()
+}
+
+// GetCart 返回按商品排序的购物车内容，并按商品目录中的当前价格计算总价
+func (c *Cache) GetCart(ctx context.Context, session string) (*Cart, error) {
+	items, err := c.Client.HGetAll(ctx, common.CartPre+session).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	cart := &Cart{Lines: make([]CartLine, 0, len(items))}
+	if len(items) == 0 {
+		return cart, nil
+	}
+
+	names := make([]string, 0, len(items))
+	for item := range items {
+		names = append(names, item)
+	}
+	sort.Strings(names)
+
+	prices, err := c.Client.HMGet(ctx, common.ProductCatalog, names...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, item := range names {
+		quantity, _ := strconv.ParseInt(items[item], 10, 64)
+		line := CartLine{Item: item, Quantity: quantity}
+		if price, ok := prices[i].(string); ok {
+			line.Price, _ = strconv.ParseInt(price, 10, 64)
+			line.Subtotal = line.Price * quantity
+			line.Available = true
+			cart.Total += line.Subtotal
+		}
+		cart.Lines = append(cart.Lines, line)
+	}
+	return cart, nil
+}
@@ -0,0 +1,571 @@
+package chapter02
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"redis-practice"
+	"redis-practice/common"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+var client *common.Client
+var ctx context.Context
+
+func TestMain(m *testing.M) {
+	ctx = context.Background()
+
+	conn := common.ConnectRedis(ctx, &common.RedisConf{
+		Addr:     redis_practice.Addr,
+		Password: redis_practice.Password,
+		DB:       redis_practice.DB,
+	})
+	if conn != nil {
+		defer conn.Close()
+		client = common.NewClient(conn)
+	}
+
+	code := m.Run()
+
+	os.Exit(code)
+}
+
+// newTestCache 返回连接测试 redis 的 Cache，redis 不可用时跳过测试
+func newTestCache(t *testing.T) *Cache {
+	if client == nil {
+		t.Skip("redis is not available")
+	}
+	client.FlushDB(ctx)
+	return NewCacheClient(client)
+}
+
+func TestEvictSessions(t *testing.T) {
+	cache := newTestCache(t)
+
+	var evicted int64
+	cache.Eviction = &EvictionConfig{
+		MaxSessions: 3,
+		BatchSize:   2,
+		IdleTTL:     time.Hour,
+		OnEvict:     func(n int64) { evicted += n },
+	}
+
+	assert.Nil(t, cache.SetPrice(ctx, "item", 100))
+	tokens := make([]string, 0, 6)
+	for i := 0; i < 6; i++ {
+		token, err := cache.Login(ctx, "user"+strconv.Itoa(i), &ClientInfo{IP: "10.0.0.1"})
+		assert.Nil(t, err)
+		assert.Nil(t, cache.UpdateTokenBehavior(ctx, token, "user"+strconv.Itoa(i), "item"))
+		assert.Nil(t, cache.AddToCart(ctx, token, "item", 1))
+		tokens = append(tokens, token)
+	}
+	// 按登录顺序排列访问时间，最早的会话已空闲超过 IdleTTL
+	now := time.Now().Unix()
+	for i, token := range tokens {
+		client.ZAdd(ctx, common.Recent, redis.Z{Score: float64(now + int64(i)), Member: token})
+	}
+	client.ZAdd(ctx, common.Recent, redis.Z{Score: float64(time.Now().Add(-2 * time.Hour).Unix()), Member: tokens[0]})
+
+	// 超出上限的 3 个会话分两批淘汰，不删除购物车
+	n, err := cache.EvictSessions(ctx, false)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+	n, _ = cache.EvictSessions(ctx, false)
+	assert.Equal(t, int64(1), n)
+	n, _ = cache.EvictSessions(ctx, false)
+	assert.Equal(t, int64(0), n)
+	assert.Equal(t, int64(3), evicted)
+
+	assert.Equal(t, int64(3), client.ZCard(ctx, common.Recent).Val())
+	assert.Equal(t, "", cache.CheckToken(ctx, tokens[0], &ClientInfo{IP: "10.0.0.1"}))
+	assert.False(t, client.HExists(ctx, common.LoginBinding, tokens[0]).Val())
+	assert.False(t, client.SIsMember(ctx, common.UserTokensPre+"user0", tokens[0]).Val())
+	assert.Equal(t, int64(0), client.Exists(ctx, common.ViewedPre+tokens[0]).Val())
+	assert.Equal(t, int64(1), client.Exists(ctx, common.CartPre+tokens[0]).Val())
+	assert.Equal(t, "user5", cache.CheckToken(ctx, tokens[5], &ClientInfo{IP: "10.0.0.1"}))
+
+	// 只按空闲时间淘汰
+	cache.Eviction = &EvictionConfig{BatchSize: 10, IdleTTL: time.Hour}
+	client.ZAdd(ctx, common.Recent, redis.Z{Score: 1, Member: tokens[3]})
+	n, _ = cache.EvictSessions(ctx, true)
+	assert.Equal(t, int64(1), n)
+	assert.Equal(t, int64(0), client.Exists(ctx, common.CartPre+tokens[3]).Val())
+
+	// 一批淘汰的会话数超过 lua unpack 的上限
+	stale := make([]redis.Z, 0, 9000)
+	for i := 0; i < cap(stale); i++ {
+		stale = append(stale, redis.Z{Score: 1, Member: "stale-" + strconv.Itoa(i)})
+	}
+	client.ZAdd(ctx, common.Recent, stale...)
+	cache.Eviction = &EvictionConfig{BatchSize: 10000, IdleTTL: time.Hour}
+	n, err = cache.EvictSessions(ctx, false)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(stale)), n)
+}
+
+func TestCart(t *testing.T) {
+	cache := newTestCache(t)
+	session := "cart-session"
+
+	assert.Nil(t, cache.SetPrice(ctx, "apple", 150))
+	assert.Nil(t, cache.SetPrice(ctx, "pear", 200))
+	assert.Equal(t, ErrInvalidPrice, cache.SetPrice(ctx, "pear", -1))
+
+	assert.Equal(t, ErrUnknownItem, cache.AddToCart(ctx, session, "banana", 1))
+	assert.Nil(t, cache.AddToCart(ctx, session, "apple", 2))
+	n, err := cache.IncrCartItem(ctx, session, "apple", 3)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), n)
+	n, _ = cache.IncrCartItem(ctx, session, "pear", 1)
+	assert.Equal(t, int64(1), n)
+
+	_, err = cache.IncrCartItem(ctx, session, "apple", common.CartMaxQuantity)
+	assert.Equal(t, ErrQuantityExceeded, err)
+	assert.Equal(t, ErrQuantityExceeded, cache.AddToCart(ctx, session, "apple", common.CartMaxQuantity+1))
+
+	cart, err := cache.GetCart(ctx, session)
+	assert.Nil(t, err)
+	assert.Equal(t, []CartLine{
+		{Item: "apple", Quantity: 5, Price: 150, Subtotal: 750, Available: true},
+		{Item: "pear", Quantity: 1, Price: 200, Subtotal: 200, Available: true},
+	}, cart.Lines)
+	assert.Equal(t, int64(950), cart.Total)
+
+	// 下架的商品保留在购物车中但不计价
+	assert.Nil(t, cache.RemoveProduct(ctx, "pear"))
+	cart, _ = cache.GetCart(ctx, session)
+	assert.False(t, cart.Lines[1].Available)
+	assert.Equal(t, int64(750), cart.Total)
+
+	// 数量减到 0 时移除该商品
+	n, _ = cache.IncrCartItem(ctx, session, "apple", -5)
+	assert.Equal(t, int64(0), n)
+	assert.Nil(t, cache.RemoveFromCart(ctx, session, "pear"))
+	cart, _ = cache.GetCart(ctx, session)
+	assert.Empty(t, cart.Lines)
+
+	assert.Nil(t, cache.AddToCart(ctx, session, "apple", 1))
+	assert.Nil(t, cache.ClearCart(ctx, session))
+	assert.Equal(t, int64(0), client.Exists(ctx, common.CartPre+session).Val())
+}
+
+func TestMergeSession(t *testing.T) {
+	cache := newTestCache(t)
+	anon := "anon-token"
+
+	assert.Nil(t, cache.SetPrice(ctx, "apple", 150))
+	assert.Nil(t, cache.SetPrice(ctx, "pear", 200))
+	assert.Nil(t, cache.UpdateTokenBehavior(ctx, anon, "", "item0"))
+	assert.Nil(t, cache.AddToCart(ctx, anon, "apple", 2))
+	assert.Nil(t, cache.AddToCart(ctx, anon, "pear", common.CartMaxQuantity))
+
+	userToken, err := cache.Login(ctx, "user", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, ErrInvalidToken, cache.MergeSession(ctx, anon, "not-logged-in"))
+	otherToken, _ := cache.Login(ctx, "other", nil)
+	assert.Equal(t, ErrInvalidToken, cache.MergeSession(ctx, otherToken, userToken), "logged-in session should not be merged")
+
+	now := time.Now().Unix()
+	for i := 1; i <= common.ViewedMax; i++ {
+		client.ZAdd(ctx, common.ViewedPre+userToken, redis.Z{Score: float64(now - int64(i)), Member: "item" + strconv.Itoa(i)})
+	}
+	assert.Nil(t, cache.AddToCart(ctx, userToken, "apple", 1))
+	assert.Nil(t, cache.AddToCart(ctx, userToken, "pear", 1))
+
+	assert.Nil(t, cache.MergeSession(ctx, anon, userToken))
+
+	cart, _ := cache.GetCart(ctx, userToken)
+	assert.Equal(t, int64(3), cart.Lines[0].Quantity)
+	assert.Equal(t, int64(common.CartMaxQuantity), cart.Lines[1].Quantity)
+
+	viewed := client.ZRevRange(ctx, common.ViewedPre+userToken, 0, -1).Val()
+	assert.Len(t, viewed, common.ViewedMax)
+	assert.Equal(t, "item0", viewed[0], "anonymous views should be kept as the most recent")
+	assert.NotContains(t, viewed, "item"+strconv.Itoa(common.ViewedMax))
+
+	assert.Equal(t, int64(0), client.Exists(ctx, common.CartPre+anon, common.ViewedPre+anon).Val())
+	assert.Equal(t, redis.Nil, client.ZScore(ctx, common.Recent, anon).Err())
+}
+
+func TestMiddleware(t *testing.T) {
+	cache := newTestCache(t)
+	client.ZAdd(ctx, common.Viewed, redis.Z{Score: -10, Member: "1"})
+
+	calls, vary := 0, "Accept-Language"
+	handler := cache.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Vary", vary)
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("item " + r.URL.Query().Get("item") + " " + r.Header.Get("Accept-Language")))
+	}))
+
+	serve := func(target, lang string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Accept-Language", lang)
+		if len(header) == 2 {
+			req.Header.Set(header[0], header[1])
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve("http://shop/item?item=1&a=b", "en")
+	assert.Equal(t, "MISS", rec.Header().Get("X-Cache"))
+	rec = serve("http://shop/item?a=b&item=1", "en")
+	assert.Equal(t, "HIT", rec.Header().Get("X-Cache"))
+	assert.Equal(t, "item 1 en", rec.Body.String())
+	assert.Equal(t, "text/plain", rec.Header().Get("Content-Type"))
+	assert.Equal(t, 1, calls)
+
+	// Vary 的请求头不同时分别缓存
+	rec = serve("http://shop/item?item=1&a=b", "zh")
+	assert.Equal(t, "MISS", rec.Header().Get("X-Cache"))
+	assert.Equal(t, "item 1 zh", rec.Body.String())
+
+	// 客户端 no-cache 时重新生成
+	rec = serve("http://shop/item?item=1&a=b", "en", "Cache-Control", "no-cache")
+	assert.Equal(t, "MISS", rec.Header().Get("X-Cache"))
+
+	// 动态请求和不在热门商品中的请求不缓存
+	rec = serve("http://shop/item?item=1&user=_123", "en")
+	assert.Equal(t, "", rec.Header().Get("X-Cache"))
+	rec = serve("http://shop/item?item=2", "en")
+	assert.Equal(t, "", rec.Header().Get("X-Cache"))
+	assert.Equal(t, 5, calls)
+
+	// 带端口的 IP 主机名
+	rec = serve("http://10.0.0.1:8080/item?item=1", "en")
+	assert.Equal(t, "MISS", rec.Header().Get("X-Cache"))
+	rec = serve("http://10.0.0.1:8080/item?item=1", "en")
+	assert.Equal(t, "HIT", rec.Header().Get("X-Cache"))
+
+	// 带 Authorization 的请求不读缓存，响应不是 public 时不缓存
+	rec = serve("http://shop/item?item=1&a=b", "en", "Authorization", "Bearer token")
+	assert.Equal(t, "MISS", rec.Header().Get("X-Cache"))
+	serve("http://shop/item?item=1&auth=1", "en", "Authorization", "Bearer token")
+	rec = serve("http://shop/item?item=1&auth=1", "en")
+	assert.Equal(t, "MISS", rec.Header().Get("X-Cache"), "authorized response should not be cached")
+	assert.Equal(t, 9, calls)
+
+	// Vary 列表改变时删除按旧列表缓存的变体
+	variantsKey := common.ReqVariantsPre + hashRequest("shop/item?a=b&item=1")
+	assert.Equal(t, int64(2), client.SCard(ctx, variantsKey).Val())
+	vary = "Accept-Encoding"
+	serve("http://shop/item?item=1&a=b", "en", "Cache-Control", "no-cache")
+	assert.Equal(t, int64(1), client.SCard(ctx, variantsKey).Val())
+	rec = serve("http://shop/item?item=1&a=b", "zh")
+	assert.Equal(t, "HIT", rec.Header().Get("X-Cache"), "new variant should be served")
+	assert.Equal(t, "item 1 en", rec.Body.String())
+}
+
+func TestCacheRequest(t *testing.T) {
+	cache := newTestCache(t)
+	cache.RequestCache = &RequestCacheConfig{TTL: 200 * time.Millisecond, StaleTTL: 5 * time.Second, LockTTL: time.Second}
+	client.ZAdd(ctx, common.Viewed, redis.Z{Score: -10, Member: "1"})
+	req := "http://shop/item?item=1"
+
+	var calls int32
+	callback := func(req string) string {
+		time.Sleep(50 * time.Millisecond)
+		return "page " + strconv.Itoa(int(atomic.AddInt32(&calls, 1)))
+	}
+
+	// 并发的缓存未命中只生成一次
+	var wg sync.WaitGroup
+	results := make([]string, 20)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = cache.CacheRequest(ctx, req, callback)
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	for _, res := range results {
+		assert.Equal(t, "page 1", res)
+	}
+
+	// 过期后先返回旧内容，并在后台重新生成
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, "page 1", cache.CacheRequest(ctx, req, callback))
+	assert.Eventually(t, func() bool {
+		return cache.CacheRequest(ctx, req, callback) == "page 2"
+	}, time.Second, 10*time.Millisecond)
+
+	// 其他节点持有锁时等待其结果
+	other := NewCacheClient(client)
+	other.RequestCache = cache.RequestCache
+	client.Del(ctx, common.ReqCachePre+req)
+	client.Set(ctx, common.ReqLockPre+req, "other-node", time.Second)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		other.storeRequest(ctx, req, "from other node", 0, other.RequestCache)
+	}()
+	assert.Equal(t, "from other node", cache.CacheRequest(ctx, req, callback))
+}
+
+type mapRowSource map[string]any
+
+func (s mapRowSource) GetRows(ctx context.Context, rowIDs []string) (map[string]any, error) {
+	rows := make(map[string]any, len(rowIDs))
+	for _, rowID := range rowIDs {
+		if row, ok := s[rowID]; ok {
+			rows[rowID] = row
+		}
+	}
+	return rows, nil
+}
+
+func TestCacheRows(t *testing.T) {
+	cache := newTestCache(t)
+	_, err := cache.RefreshRows(ctx)
+	assert.Equal(t, ErrNoRowSource, err)
+
+	source := mapRowSource{}
+	cache.RowSource = source
+	cache.RowCodec = MsgpackCodec
+	for i := 0; i < common.RowCacheBatch+10; i++ {
+		rowID := strconv.Itoa(i)
+		source[rowID] = testRow{ID: rowID, Price: int64(i)}
+		assert.Nil(t, cache.ScheduleRowCache(ctx, rowID, 60))
+	}
+	assert.Nil(t, cache.ScheduleRowCache(ctx, "missing", 60))
+	assert.Nil(t, cache.ScheduleRowCache(ctx, "1", 0))
+
+	// 到期的数据行分批刷新
+	n, err := cache.RefreshRows(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, common.RowCacheBatch, n)
+	n, _ = cache.RefreshRows(ctx)
+	assert.Equal(t, 11, n)
+	n, _ = cache.RefreshRows(ctx)
+	assert.Equal(t, 0, n)
+
+	var row testRow
+	found, err := cache.GetCachedRow(ctx, "42", &row)
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, testRow{ID: "42", Price: 42}, row)
+
+	found, _ = cache.GetCachedRow(ctx, "missing", &row)
+	assert.False(t, found)
+	assert.NotEqual(t, redis.Nil, client.ZScore(ctx, common.Schedule, "missing").Err(), "missing rows should stay scheduled")
+
+	// delay 为 0 的数据行取消调度并删除缓存
+	found, _ = cache.GetCachedRow(ctx, "1", &row)
+	assert.False(t, found)
+	assert.Equal(t, redis.Nil, client.ZScore(ctx, common.Schedule, "1").Err())
+	assert.False(t, client.HExists(ctx, common.Delay, "1").Val())
+
+	// 编码失败的行不影响同一批的其他行
+	cache.RowCodec = JSONCodec
+	source["bad"] = make(chan int)
+	source["good"] = testRow{ID: "good"}
+	assert.Nil(t, cache.ScheduleRowCache(ctx, "bad", 60))
+	assert.Nil(t, cache.ScheduleRowCache(ctx, "good", 60))
+	n, err = cache.RefreshRows(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	found, _ = cache.GetCachedRow(ctx, "good", &row)
+	assert.True(t, found)
+	assert.Greater(t, client.ZScore(ctx, common.Schedule, "bad").Val(), float64(time.Now().Unix()), "bad rows should be rescheduled")
+}
+
+func TestInvalidationBus(t *testing.T) {
+	cache := newTestCache(t)
+	bus := NewInvalidationBus(client)
+	received := make(chan Invalidation, 10)
+	bus.OnInvalidate(func(inv Invalidation) { received <- inv })
+
+	subscribe := func() (cancel func()) {
+		subCtx, cancelSub := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			bus.Subscribe(subCtx)
+			close(done)
+		}()
+		assert.Eventually(t, func() bool {
+			return client.PubSubNumSub(ctx, common.InvalidationChannel).Val()[common.InvalidationChannel] == 1
+		}, time.Second, 10*time.Millisecond)
+		time.Sleep(100 * time.Millisecond)
+		return func() {
+			cancelSub()
+			<-done
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	next := func() Invalidation {
+		select {
+		case inv := <-received:
+			return inv
+		case <-time.After(time.Second):
+			t.Fatal("invalidation not received")
+			return Invalidation{}
+		}
+	}
+
+	// 失效数据行缓存和该商品的网页缓存
+	client.ZAdd(ctx, common.Viewed, redis.Z{Score: -10, Member: "1"})
+	cache.CacheRequest(ctx, "http://shop/item?item=1", func(string) string { return "page" })
+	client.Set(ctx, common.RowCachePre+"1", "row", 0)
+
+	unsubscribe := subscribe()
+	assert.Nil(t, bus.Invalidate(ctx, "1"))
+	inv := next()
+	assert.Equal(t, InvalidationRow, inv.Kind)
+	assert.Equal(t, "1", inv.Key)
+	assert.Equal(t, int64(0), client.Exists(ctx, common.RowCachePre+"1", common.ReqCachePre+"http://shop/item?item=1").Val())
+
+	// 断开期间的消息在重新订阅后补齐
+	unsubscribe()
+	client.Set(ctx, common.RowCachePre+"30", "row", 0)
+	client.Set(ctx, common.RowCachePre+"31", "row", 0)
+	client.Set(ctx, common.RowCachePre+"4", "row", 0)
+	assert.Nil(t, bus.Invalidate(ctx, "2"))
+	assert.Nil(t, bus.InvalidatePrefix(ctx, "3"))
+	assert.Equal(t, int64(1), client.Exists(ctx, common.RowCachePre+"30", common.RowCachePre+"31", common.RowCachePre+"4").Val())
+
+	unsubscribe = subscribe()
+	assert.Equal(t, "2", next().Key)
+	inv = next()
+	assert.Equal(t, InvalidationPrefix, inv.Kind)
+	assert.Equal(t, "3", inv.Key)
+
+	// 错过的消息已从日志中淘汰时要求丢弃所有本地副本
+	unsubscribe()
+	assert.Nil(t, bus.Invalidate(ctx, "5"))
+	client.XTrimMaxLen(ctx, common.InvalidationLog, 0)
+	assert.Nil(t, bus.Invalidate(ctx, "6"))
+
+	unsubscribe = subscribe()
+	defer unsubscribe()
+	assert.Equal(t, InvalidationAll, next().Kind)
+	assert.Equal(t, "6", next().Key)
+}
+
+func TestCoViewRecommendations(t *testing.T) {
+	cache := newTestCache(t)
+
+	for token, items := range map[string][]string{
+		"session1": {"a", "b", "c"},
+		"session2": {"a", "b"},
+		"session3": {"a", "d"},
+	} {
+		for _, item := range items {
+			assert.Nil(t, cache.UpdateTokenBehavior(ctx, token, "", item))
+		}
+	}
+	// 重复浏览不重复计数
+	assert.Nil(t, cache.UpdateTokenBehavior(ctx, "session1", "", "a"))
+
+	assert.Equal(t, float64(2), client.ZScore(ctx, common.CoViewedPre+"a", "b").Val())
+	related, err := cache.RelatedItems(ctx, "a", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"b"}, related)
+
+	assert.Nil(t, cache.UpdateTokenBehavior(ctx, "session4", "", "a"))
+	items, err := cache.RecommendForSession(ctx, "session4", 3)
+	assert.Nil(t, err)
+	assert.Len(t, items, 3)
+	assert.Equal(t, "b", items[0])
+	assert.NotContains(t, items, "a")
+
+	// 浏览新商品后重新汇总
+	assert.Nil(t, cache.UpdateTokenBehavior(ctx, "session4", "", "b"))
+	items, _ = cache.RecommendForSession(ctx, "session4", 3)
+	assert.Equal(t, []string{"c", "d"}, items)
+
+	// 没有浏览记录时返回最热门的商品
+	items, _ = cache.RecommendForSession(ctx, "session5", 1)
+	assert.Equal(t, []string{"a"}, items)
+
+	// 分值不断减半后被移除
+	assert.Nil(t, cache.rescaleCoViews(ctx))
+	assert.Equal(t, float64(1), client.ZScore(ctx, common.CoViewedPre+"a", "b").Val())
+	for i := 0; i < 8; i++ {
+		assert.Nil(t, cache.rescaleCoViews(ctx))
+	}
+	assert.Equal(t, int64(0), client.Exists(ctx, common.CoViewedPre+"a").Val())
+	assert.Equal(t, int64(0), client.SCard(ctx, common.CoViewedItems).Val())
+
+	// 共同浏览已满时，新出现的同分商品不会被随意淘汰，低分商品被移除
+	full := make([]redis.Z, 0, common.CoViewedMax)
+	for i := 0; i < common.CoViewedMax; i++ {
+		full = append(full, redis.Z{Score: 1, Member: "old" + strconv.Itoa(i)})
+	}
+	full[0].Score = 0.5
+	client.ZAdd(ctx, common.CoViewedPre+"x", full...)
+	assert.Nil(t, cache.UpdateTokenBehavior(ctx, "session6", "", "x"))
+	assert.Nil(t, cache.UpdateTokenBehavior(ctx, "session6", "", "zz"))
+	assert.Equal(t, float64(1), client.ZScore(ctx, common.CoViewedPre+"x", "zz").Val())
+	assert.Equal(t, redis.Nil, client.ZScore(ctx, common.CoViewedPre+"x", "old0").Err())
+	assert.Equal(t, int64(common.CoViewedMax), client.ZCard(ctx, common.CoViewedPre+"x").Val())
+}
+
+func TestIndexPage(t *testing.T) {
+	newTestCache(t)
+
+	_, err := client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		indexPage(ctx, pipe, "item", "long", time.Hour)
+		indexPage(ctx, pipe, "item", "short", time.Minute)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), client.SCard(ctx, common.ReqCacheItemPre+"item").Val())
+	assert.Greater(t, client.TTL(ctx, common.ReqCacheItemPre+"item").Val(), time.Minute, "shorter pages should not shorten the index")
+}
+
+func TestNearCacheSessions(t *testing.T) {
+	cache := newTestCache(t)
+	err := client.EnableNearCache(ctx, &common.NearCacheOptions{Prefixes: []string{common.SessionPre}})
+	if err == common.ErrNearCacheUnsupported {
+		t.Skip(err)
+	}
+	assert.Nil(t, err)
+	defer client.DisableNearCache()
+	cache.NearCacheSessions = true
+
+	info := &ClientInfo{IP: "10.0.0.1"}
+	token, err := cache.Login(ctx, "user", info)
+	assert.Nil(t, err)
+	other, _ := cache.Login(ctx, "other", nil)
+	assert.Equal(t, "user", cache.CheckToken(ctx, token, info))
+	assert.Equal(t, "user", cache.CheckToken(ctx, token, info))
+	assert.Equal(t, "", cache.CheckToken(ctx, token, &ClientInfo{IP: "10.0.0.2"}), "binding should be cached too")
+	hits := client.NearCache().Stats().Hits
+	assert.Greater(t, hits, int64(0))
+
+	// 其他 token 注销不影响该 token 的近端缓存
+	assert.Nil(t, cache.Logout(ctx, other))
+	assert.Equal(t, "user", cache.CheckToken(ctx, token, info))
+	assert.Greater(t, client.NearCache().Stats().Hits, hits)
+
+	rotated, err := cache.RotateToken(ctx, token)
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool { return cache.CheckToken(ctx, token, info) == "" }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "user", cache.CheckToken(ctx, rotated, info))
+
+	assert.Nil(t, cache.Logout(ctx, rotated))
+	assert.Eventually(t, func() bool { return cache.CheckToken(ctx, rotated, info) == "" }, time.Second, 10*time.Millisecond)
+
+	// 淘汰的会话一并删除会话哈希
+	evicted, _ := cache.Login(ctx, "user", nil)
+	client.ZAdd(ctx, common.Recent, redis.Z{Score: 1, Member: evicted})
+	cache.Eviction = &EvictionConfig{IdleTTL: time.Hour}
+	n, err := cache.EvictSessions(ctx, false)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+	assert.Equal(t, int64(0), client.Exists(ctx, common.SessionPre+evicted).Val())
+}
@@ -0,0 +1,26 @@
+package chapter02
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testRow struct {
+	ID    string
+	Name  string
+	Price int64
+	Tags  []string
+}
+
+func TestRowCodecs(t *testing.T) {
+	row := testRow{ID: "1", Name: "apple", Price: 150, Tags: []string{"fruit", "red"}}
+	for name, codec := range map[string]RowCodec{"json": JSONCodec, "msgpack": MsgpackCodec, "gob": GobCodec} {
+		data, err := codec.Marshal(row)
+		assert.Nil(t, err, name)
+
+		var decoded testRow
+		assert.Nil(t, codec.Unmarshal(data, &decoded), name)
+		assert.Equal(t, row, decoded, name)
+	}
+}
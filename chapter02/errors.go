@@ -0,0 +1,16 @@
+package chapter02
+
+import "errors"
+
+var (
+	// ErrInvalidToken token 不存在、已失效或不属于该用户
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrUnknownItem 商品不在商品目录中
+	ErrUnknownItem = errors.New("item not in catalog")
+	// ErrInvalidPrice 商品价格为负
+	ErrInvalidPrice = errors.New("invalid price")
+	// ErrQuantityExceeded 购物车中商品数量超过 common.CartMaxQuantity
+	ErrQuantityExceeded = errors.New("cart quantity exceeded")
+	// ErrInvalidEvictionConfig 会话淘汰配置的批大小或间隔不合法
+	ErrInvalidEvictionConfig = errors.New("invalid eviction config")
+)
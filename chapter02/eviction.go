@@ -0,0 +1,180 @@
+package chapter02
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"redis-practice/common"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+// EvictionConfig 会话淘汰配置
+type EvictionConfig struct {
+	// MaxSessions 会话数超过该值时从最早访问的会话开始淘汰，0 表示不限制
+	MaxSessions int64
+	// BatchSize 每批最多淘汰的会话数，每批在一个脚本中完成，不会长时间阻塞 redis，0 表示使用默认值
+	BatchSize int64
+	// IdleTTL 超过该时间未访问的会话会被淘汰，0 表示不按空闲时间淘汰
+	IdleTTL time.Duration
+	// Interval 没有待淘汰的会话时，下次检查前的等待时间，0 表示使用默认值
+	Interval time.Duration
+	// OnEvict 每批淘汰后以淘汰数回调，可用于上报指标
+	OnEvict func(evicted int64)
+}
+
+func DefaultEvictionConfig() *EvictionConfig {
+	return &EvictionConfig{
+		MaxSessions: common.SessionMax,
+		BatchSize:   common.SessionEvictBatch,
+		Interval:    time.Second,
+	}
+}
+
+// evictScript 淘汰最早访问的一批会话，返回被淘汰的 token 和对应的用户（未登录为空字符串），交替排列。
+// 候选 token 由调用方预先读取，其会话哈希与登录信息在脚本中一起删除，不在候选中的 token 留到下一批；
+// 浏览记录、购物车和用户 token 集合由调用方在脚本之后删除，使脚本只访问 KEYS 中声明的 key
+//
+// KEYS: recent, login, login-binding, 候选 token 的会话哈希...
+// ARGV: 最大会话数, 空闲截止时间, 批大小, 候选 token...
+var evictScript = redis.NewScript(`
+local limit = tonumber(ARGV[1])
+local batch = tonumber(ARGV[3])
+local n = 0
+if limit > 0 then
+	n = redis.call('ZCARD', KEYS[1]) - limit
+end
+local idle = redis.call('ZCOUNT', KEYS[1], '-inf', ARGV[2])
+if idle > n then
+	n = idle
+end
+if n > batch then
+	n = batch
+end
+if n <= 0 then
+	return {}
+end
+
+local sessions = {}
+for i = 4, #ARGV do
+	sessions[ARGV[i]] = KEYS[i]
+end
+
+local evicted = {}
+for _, token in ipairs(redis.call('ZRANGE', KEYS[1], 0, n - 1)) do
+	local session = sessions[token]
+	if session then
+		local user = redis.call('HGET', KEYS[2], token)
+		redis.call('ZREM', KEYS[1], token)
+		redis.call('HDEL', KEYS[2], token)
+		redis.call('HDEL', KEYS[3], token)
+		redis.call('DEL', session)
+		evicted[#evicted + 1] = token
+		evicted[#evicted + 1] = user or ''
+	end
+end
+return evicted
+`)
+
+// eviction 返回淘汰配置，未设置的批大小和间隔使用 DefaultEvictionConfig 中的值，
+// 批大小或间隔为负时返回 ErrInvalidEvictionConfig
+func (c *Cache) eviction() (*EvictionConfig, error) {
+	if c.Eviction == nil {
+		return DefaultEvictionConfig(), nil
+	}
+
+	cfg := *c.Eviction
+	if cfg.BatchSize < 0 || cfg.Interval < 0 {
+		return nil, ErrInvalidEvictionConfig
+	}
+	defaults := DefaultEvictionConfig()
+	if cfg.BatchSize == 0 {
+		cfg.BatchSize = defaults.BatchSize
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = defaults.Interval
+	}
+	return &cfg, nil
+}
+
+// EvictSessions 按淘汰配置淘汰一批会话，withCart 为 true 时一并删除购物车，返回淘汰数
+func (c *Cache) EvictSessions(ctx context.Context, withCart bool) (int64, error) {
+	cfg, err := c.eviction()
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := "-inf"
+	if cfg.IdleTTL > 0 {
+		cutoff = strconv.FormatInt(time.Now().Add(-cfg.IdleTTL).Unix(), 10)
+	}
+	candidates, err := c.Client.ZRange(ctx, common.Recent, 0, cfg.BatchSize-1).Result()
+	if err != nil || len(candidates) == 0 {
+		return 0, err
+	}
+	keys := []string{common.Recent, common.LoginHash, common.LoginBinding}
+	args := []any{cfg.MaxSessions, cutoff, cfg.BatchSize}
+	for _, token := range candidates {
+		keys = append(keys, common.SessionPre+token)
+		args = append(args, token)
+	}
+
+	res, err := evictScript.Run(ctx, c.Client, keys, args...).StringSlice()
+	if err != nil {
+		return 0, err
+	}
+
+	evicted := int64(len(res) / 2)
+	if evicted > 0 {
+		// 会话已从登录信息中移除，删除失败只会残留无法再访问的数据
+		if err := c.removeSessionData(ctx, res, withCart); err != nil {
+			logrus.Errorf("remove evicted sessions data failed, err: %v", err)
+		}
+		logrus.Infof("evicted %d sessions", evicted)
+		if cfg.OnEvict != nil {
+			cfg.OnEvict(evicted)
+		}
+	}
+	return evicted, nil
+}
+
+// removeSessionData 流水线删除被淘汰会话的浏览记录、购物车（withCart 为 true 时），
+// 并从用户 token 集合中移除，evicted 为 evictScript 的返回值
+func (c *Cache) removeSessionData(ctx context.Context, evicted []string, withCart bool) error {
+	_, err := c.Client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i := 0; i+1 < len(evicted); i += 2 {
+			token, user := evicted[i], evicted[i+1]
+			pipe.Del(ctx, common.ViewedPre+token)
+			if withCart {
+				pipe.Del(ctx, common.CartPre+token)
+			}
+			if user != "" {
+				pipe.SRem(ctx, common.UserTokensPre+user, token)
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// evictLoop 持续分批淘汰会话，直到 ctx 取消
+func (c *Cache) evictLoop(ctx context.Context, withCart bool) error {
+	cfg, err := c.eviction()
+	if err != nil {
+		return err
+	}
+	for {
+		evicted, err := c.EvictSessions(ctx, withCart)
+		if err != nil {
+			return err
+		}
+		// 一批没有删满说明已经没有待淘汰的会话，休眠再重新检查
+		if evicted < cfg.BatchSize {
+			if err := common.SleepContext(ctx, cfg.Interval); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package chapter02
+
+import (
+	"testing"
+	"time"
+
+	"redis-practice/common"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvictionConfig(t *testing.T) {
+	cache := &Cache{Eviction: &EvictionConfig{IdleTTL: time.Hour}}
+	cfg, err := cache.eviction()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(common.SessionEvictBatch), cfg.BatchSize)
+	assert.Equal(t, time.Second, cfg.Interval)
+	assert.Equal(t, int64(0), cfg.MaxSessions, "zero MaxSessions should stay unlimited")
+	assert.Equal(t, int64(0), cache.Eviction.BatchSize, "caller's config should not be modified")
+
+	cache.Eviction.BatchSize = -1
+	_, err = cache.eviction()
+	assert.Equal(t, ErrInvalidEvictionConfig, err)
+}
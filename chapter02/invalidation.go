@@ -0,0 +1,292 @@
+package chapter02
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"redis-practice/common"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+// InvalidationKind 缓存失效消息的类型
+type InvalidationKind string
+
+const (
+	// InvalidationRow 失效单个数据行及其商品的网页缓存
+	InvalidationRow InvalidationKind = "row"
+	// InvalidationPrefix 失效 id 以 Key 为前缀的所有数据行及其商品的网页缓存
+	InvalidationPrefix InvalidationKind = "prefix"
+	// InvalidationAll 订阅者错过了已从日志中淘汰的消息，需要丢弃所有本地副本
+	InvalidationAll InvalidationKind = "all"
+)
+
+// Invalidation 缓存失效消息
+type Invalidation struct {
+	Seq  int64            `json:"seq"`
+	ID   string           `json:"id"`
+	Kind InvalidationKind `json:"kind"`
+	Key  string           `json:"key"`
+}
+
+// Matches 判断数据行或商品 id 是否受该消息影响
+func (inv Invalidation) Matches(id string) bool {
+	switch inv.Kind {
+	case InvalidationRow:
+		return id == inv.Key
+	case InvalidationPrefix:
+		return strings.HasPrefix(id, inv.Key)
+	default:
+		return true
+	}
+}
+
+// publishScript 原子地为失效消息分配序号、写入日志并发布
+//
+// KEYS: 序号, 日志
+// ARGV: 类型, key, 频道, 日志最大长度
+var publishScript = redis.NewScript(`
+redis.replicate_commands()
+local seq = redis.call('INCR', KEYS[1])
+local id = redis.call('XADD', KEYS[2], 'MAXLEN', '~', ARGV[4], '*', 'seq', seq, 'kind', ARGV[1], 'key', ARGV[2])
+redis.call('PUBLISH', ARGV[3], cjson.encode({seq = seq, id = id, kind = ARGV[1], key = ARGV[2]}))
+return seq
+`)
+
+// InvalidationBus 通过 Pub/Sub 在节点间传播缓存失效：发布方删除 redis 中的数据行和网页缓存，
+// 订阅的节点收到消息后由 OnInvalidate 注册的回调丢弃本地副本。
+// 消息同时写入日志，订阅者断线重连或发现序号不连续时从日志补齐，日志已淘汰时收到 InvalidationAll
+type InvalidationBus struct {
+	client *common.Client
+
+	mu       sync.Mutex
+	handlers []func(Invalidation)
+
+	// 订阅者已处理的最后一条消息，只在 Subscribe 的协程中访问
+	lastSeq int64
+	lastID  string
+}
+
+func NewInvalidationBus(client *common.Client) *InvalidationBus {
+	return &InvalidationBus{client: client}
+}
+
+// OnInvalidate 注册收到失效消息时的回调，回调在订阅协程中依次执行
+func (b *InvalidationBus) OnInvalidate(handler func(Invalidation)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, handler)
+}
+
+// Invalidate 删除数据行缓存和该商品的网页缓存，并通知所有节点
+func (b *InvalidationBus) Invalidate(ctx context.Context, rowID string) error {
+	if err := b.deleteRow(ctx, rowID); err != nil {
+		return err
+	}
+	return b.publish(ctx, InvalidationRow, rowID)
+}
+
+// InvalidatePrefix 删除 id 以 prefix 为前缀的所有数据行缓存和网页缓存，并通知所有节点
+func (b *InvalidationBus) InvalidatePrefix(ctx context.Context, prefix string) error {
+	pattern := escapePattern(prefix) + "*"
+
+	var cursor uint64
+	for {
+		keys, next, err := b.client.Scan(ctx, cursor, common.RowCachePre+pattern, 1000).Result()
+		if err != nil {
+			return err
+		}
+		if len(keys) != 0 {
+			if err := b.client.Del(ctx, keys...).Err(); err != nil {
+				return err
+			}
+		}
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+
+	for {
+		keys, next, err := b.client.Scan(ctx, cursor, common.ReqCacheItemPre+pattern, 1000).Result()
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := b.deleteRow(ctx, strings.TrimPrefix(key, common.ReqCacheItemPre)); err != nil {
+				return err
+			}
+		}
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+
+	return b.publish(ctx, InvalidationPrefix, prefix)
+}
+
+// deleteRow 删除数据行缓存和该商品的所有网页缓存
+func (b *InvalidationBus) deleteRow(ctx context.Context, rowID string) error {
+	indexKey := common.ReqCacheItemPre + rowID
+	pages, err := b.client.SMembers(ctx, indexKey).Result()
+	if err != nil {
+		return err
+	}
+	keys := append(pages, common.RowCachePre+rowID, indexKey)
+	return b.client.Del(ctx, keys...).Err()
+}
+
+func (b *InvalidationBus) publish(ctx context.Context, kind InvalidationKind, key string) error {
+	return publishScript.Run(ctx, b.client,
+		[]string{common.InvalidationSeq, common.InvalidationLog},
+		string(kind), key, common.InvalidationChannel, common.InvalidationLogMaxLen,
+	).Err()
+}
+
+// Subscribe 订阅失效消息直到 ctx 取消，连接断开时自动重连并从日志补齐错过的消息
+func (b *InvalidationBus) Subscribe(ctx context.Context) error {
+	pubsub := b.client.Subscribe(ctx, common.InvalidationChannel)
+	defer pubsub.Close()
+
+	for {
+		msg, err := pubsub.Receive(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			// 下一次 Receive 会重新连接并重新订阅
+			logrus.Errorf("receive invalidation failed, err: %v", err)
+			if err := common.SleepContext(ctx, time.Second); err != nil {
+				return err
+			}
+			continue
+		}
+
+		switch m := msg.(type) {
+		case *redis.Subscription:
+			// 首次订阅或重连后重新订阅成功，补齐期间错过的消息
+			if m.Kind == "subscribe" {
+				if err := b.resync(ctx); err != nil {
+					logrus.Errorf("resync invalidations failed, err: %v", err)
+				}
+			}
+		case *redis.Message:
+			b.receive(ctx, m.Payload)
+		}
+	}
+}
+
+func (b *InvalidationBus) receive(ctx context.Context, payload string) {
+	var inv Invalidation
+	if err := json.Unmarshal([]byte(payload), &inv); err != nil {
+		logrus.Errorf("unmarshal invalidation %s failed, err: %v", payload, err)
+		return
+	}
+
+	switch {
+	case inv.Seq <= b.lastSeq:
+		// 补齐时已处理过
+	case inv.Seq == b.lastSeq+1:
+		b.apply(inv)
+	default:
+		// 序号不连续，说明错过了消息
+		if err := b.resync(ctx); err != nil {
+			logrus.Errorf("resync invalidations failed, err: %v", err)
+		}
+	}
+}
+
+// resync 从日志中补齐 lastID 之后的消息，首次调用时只记录日志的最新位置
+func (b *InvalidationBus) resync(ctx context.Context) error {
+	if b.lastID == "" {
+		var seqCmd *redis.StringCmd
+		var latestCmd *redis.XMessageSliceCmd
+		_, err := b.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			seqCmd = pipe.Get(ctx, common.InvalidationSeq)
+			latestCmd = pipe.XRevRangeN(ctx, common.InvalidationLog, "+", "-", 1)
+			return nil
+		})
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		b.lastSeq, _ = seqCmd.Int64()
+		b.lastID = "0"
+		if latest := latestCmd.Val(); len(latest) != 0 {
+			b.lastID = latest[0].ID
+		}
+		return nil
+	}
+
+	entries, err := b.client.XRange(ctx, common.InvalidationLog, b.lastID, "+").Result()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		inv := parseInvalidation(entry)
+		if inv.Seq <= b.lastSeq {
+			continue
+		}
+		if inv.Seq > b.lastSeq+1 {
+			// 中间的消息已从日志中淘汰
+			b.apply(Invalidation{Seq: inv.Seq - 1, ID: inv.ID, Kind: InvalidationAll})
+		}
+		b.apply(inv)
+	}
+	return nil
+}
+
+func (b *InvalidationBus) apply(inv Invalidation) {
+	b.lastSeq, b.lastID = inv.Seq, inv.ID
+
+	b.mu.Lock()
+	handlers := b.handlers
+	b.mu.Unlock()
+	for _, handler := range handlers {
+		handler(inv)
+	}
+}
+
+func parseInvalidation(msg redis.XMessage) Invalidation {
+	kind, _ := msg.Values["kind"].(string)
+	key, _ := msg.Values["key"].(string)
+	seq, _ := msg.Values["seq"].(string)
+	n, _ := strconv.ParseInt(seq, 10, 64)
+	return Invalidation{Seq: n, ID: msg.ID, Kind: InvalidationKind(kind), Key: key}
+}
+
+// indexPageScript 将网页缓存 key 加入商品索引，索引的过期时间只延长不缩短，
+// 使其不早于索引中任何网页缓存过期，EXPIRE 的 GT 选项需要 7.0
+//
+// KEYS: 商品索引
+// ARGV: 网页缓存 key, 毫秒过期时间
+var indexPageScript = redis.NewScript(`
+redis.call('SADD', KEYS[1], ARGV[1])
+if redis.call('PTTL', KEYS[1]) < tonumber(ARGV[2]) then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 1
+`)
+
+// indexPage 在流水线中将网页缓存 key 记录到商品的索引中，供按商品失效
+func indexPage(ctx context.Context, pipe redis.Pipeliner, item, pageKey string, ttl time.Duration) {
+	if item == "" {
+		return
+	}
+	indexPageScript.Eval(ctx, pipe, []string{common.ReqCacheItemPre + item}, pageKey, ttl.Milliseconds())
+}
+
+// escapePattern 转义 SCAN 模式中的特殊字符
+func escapePattern(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
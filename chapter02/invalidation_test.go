@@ -0,0 +1,19 @@
+package chapter02
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInvalidationMatches(t *testing.T) {
+	assert.True(t, Invalidation{Kind: InvalidationRow, Key: "12"}.Matches("12"))
+	assert.False(t, Invalidation{Kind: InvalidationRow, Key: "12"}.Matches("123"))
+	assert.True(t, Invalidation{Kind: InvalidationPrefix, Key: "12"}.Matches("123"))
+	assert.False(t, Invalidation{Kind: InvalidationPrefix, Key: "12"}.Matches("21"))
+	assert.True(t, Invalidation{Kind: InvalidationAll}.Matches("anything"))
+}
+
+func TestEscapePattern(t *testing.T) {
+	assert.Equal(t, `a\*b\?\[c\]\\`, escapePattern(`a*b?[c]\`))
+}
@@ -4,36 +4,84 @@ import (
 	"context"
 	"crypto"
 	"encoding/hex"
-	"encoding/json"
-	"log"
 	"net/url"
-	"strconv"
 	"strings"
-	"sync/atomic"
 	"time"
 
 	"redis-practice/common"
 
 	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
 )
 
 type Cache struct {
 	Client *common.Client
+	// RequestLimiter 按 token 限制请求频率，为 nil 时不限流
+	RequestLimiter common.RateLimiter
+	// Eviction 会话淘汰配置，为 nil 时使用 DefaultEvictionConfig
+	Eviction *EvictionConfig
+	// RequestCache 网页请求缓存配置，为 nil 时使用 DefaultRequestCacheConfig
+	RequestCache *RequestCacheConfig
+	// RowSource 数据行缓存的数据来源，CacheRows 需要设置
+	RowSource RowSource
+	// RowCodec 数据行缓存的编码方式，为 nil 时使用 JSONCodec
+	RowCodec RowCodec
+	// NearCacheSessions 为 true 时登录会额外写入 token 的会话哈希，CheckToken 通过 Client 的近端缓存读取它，
+	// 需要先调用 Client.EnableNearCache，建议以 common.SessionPre 作为广播前缀；
+	// 开启前登录的会话没有会话哈希，仍从 login 哈希读取
+	NearCacheSessions bool
+
+	// flight 合并本进程内对同一请求的并发生成
+	flight singleflight.Group
+}
+
+// NewCacheClient 创建 Cache，与 chapter01.NewArticleRepo 一样默认开启限流，
+// 每个 token 每秒补充 10 次、最多连续 100 次请求
+func NewCacheClient(conn *common.Client) *Cache {
+	return &Cache{
+		Client:         conn,
+		RequestLimiter: common.NewTokenBucketLimiter(conn, 10, 100),
+	}
 }
 
-func NewCacheClient(conn *common.Client) *Cache {
-	return &Cache{Client: conn}
+// CheckToken 检查该 token 是否被授权，返回相应的 user id，
+// token 绑定了客户端时 client 必须与登录时一致，client 为 nil 时绑定的 token 不能通过检查
+func (c *Cache) CheckToken(ctx context.Context, token string, client *ClientInfo) string {
+	user, binding := c.session(ctx, token)
+	if user == "" {
+		return ""
+	}
+	if binding != "" && (client == nil || !client.matches(binding)) {
+		return ""
+	}
+	return user
 }
 
-// CheckToken 检查该 token 是否被授权，返回相应的 user id
-func (c *Cache) CheckToken(ctx context.Context, token string) string {
-	return c.Client.HGet(ctx, common.LoginHash, token).Val()
+// session 返回 token 的登录用户和客户端绑定，NearCacheSessions 为 true 时先通过近端缓存读取会话哈希
+func (c *Cache) session(ctx context.Context, token string) (string, string) {
+	if c.NearCacheSessions {
+		key := common.SessionPre + token
+		if user, err := c.Client.CachedHGet(ctx, key, "user"); err == nil {
+			binding, _ := c.Client.CachedHGet(ctx, key, "binding")
+			return user, binding
+		}
+	}
+	return c.Client.HGet(ctx, common.LoginHash, token).Val(), c.Client.HGet(ctx, common.LoginBinding, token).Val()
 }
 
-// UpdateTokenBehavior 新的请求到来时，存储/更新用户的 token，所对应的最后访问时间，所浏览的商品
-func (c *Cache) UpdateTokenBehavior(ctx context.Context, token, user, item string) {
-	// 存储/更新用户 token
-	c.Client.HSet(ctx, common.LoginHash, token, user)
+// UpdateTokenBehavior 新的请求到来时，更新 token 所对应的最后访问时间，所浏览的商品，
+// user 不为空时 token 必须是 Login 为该用户签发的，否则返回 ErrInvalidToken，
+// 请求过于频繁时返回 *common.RateLimitError
+func (c *Cache) UpdateTokenBehavior(ctx context.Context, token, user, item string) error {
+	if err := common.CheckRateLimit(ctx, c.RequestLimiter, "request:"+token); err != nil {
+		return err
+	}
+
+	// 不再信任调用方传入的 token，登录 token 只由 Login 签发
+	if owner := c.Client.HGet(ctx, common.LoginHash, token).Val(); owner != user {
+		return ErrInvalidToken
+	}
 	now := time.Now().Unix()
 	// 更新最后访问时间
 	c.Client.ZAdd(ctx, common.Recent, redis.Z{
@@ -42,122 +90,48 @@ func (c *Cache) UpdateTokenBehavior(ctx context.Context, token, user, item strin
 	})
 	// 更新浏览商品
 	if item != "" {
+		// 先与会话中之前浏览过的商品记录共同浏览
+		if err := c.recordCoViews(ctx, token, item); err != nil {
+			return err
+		}
 		c.Client.ZAdd(ctx, common.ViewedPre+token, redis.Z{
 			Score:  float64(now),
 			Member: item,
 		})
-		// 删除排名在 倒数第一 到 正数 26 之间的所有成员
-		c.Client.ZRemRangeByRank(ctx, common.ViewedPre+token, 0, -26)
+		// 只保留最近浏览的 common.ViewedMax 个商品
+		c.Client.ZRemRangeByRank(ctx, common.ViewedPre+token, 0, -common.ViewedMax-1)
 		// 某个商品被浏览，将将其的分值-1，使得被浏览次数最多的商品在最前面
 		c.Client.ZIncrBy(ctx, common.Viewed, -1, item)
 	}
+	return nil
 }
 
-// RescaleViewed 定期调整商品总浏览数集合
-func (c *Cache) RescaleViewed(ctx context.Context) {
-	for !common.QUIT {
+// RescaleViewed 定期调整商品总浏览数集合和共同浏览集合，直到 ctx 取消
+func (c *Cache) RescaleViewed(ctx context.Context) error {
+	for {
 		c.Client.ZRemRangeByRank(ctx, common.Viewed, 0, -20001)
 		c.Client.ZInterStore(ctx, common.Viewed, &redis.ZStore{
 			Keys:      []string{common.Viewed},
 			Weights:   []float64{0.5},
 			Aggregate: "",
 		})
-		time.Sleep(300 * time.Second)
-	}
-}
-
-// CleanSession 清理会话
-func (c *Cache) CleanSession(ctx context.Context) {
-	// 如果退出了就不再执行
-	for !common.QUIT {
-		// 检查是否到达限制，如果未达限制则休眠再重新检查
-		size := c.Client.ZCard(ctx, common.Recent).Val()
-		if size <= common.LIMIT {
-			time.Sleep(1 * time.Second)
-			continue
+		if err := c.rescaleCoViews(ctx); err != nil {
+			logrus.Errorf("rescale co-viewed items failed, err: %v", err)
 		}
-		// 一次最多删除一百条
-		endIndex := common.LIMIT
-		if size < endIndex {
-			endIndex = size
+		if err := common.SleepContext(ctx, 300*time.Second); err != nil {
+			return err
 		}
-		// 在最近访问中找出最早的一部分 token 记录
-		tokens := c.Client.ZRange(ctx, common.Recent, 0, endIndex-1).Val()
-
-		sessionKeys := make([]string, 0, len(tokens))
-		for _, token := range tokens {
-			sessionKeys = append(sessionKeys, common.ViewedPre+token)
-		}
-
-		c.Client.HDel(ctx, common.LoginHash, tokens...)
-		c.Client.ZRem(ctx, common.Recent, tokens)
-		c.Client.Del(ctx, sessionKeys...)
 	}
-
-	defer atomic.AddInt32(&common.FLAG, -1)
-
 }
 
-// AddToCart 增加商品到购物车
-func (c *Cache) AddToCart(ctx context.Context, session, item string, count int) {
-	switch {
-	case count <= 0:
-		c.Client.Del(ctx, common.CartPre+session)
-
-	case count > 0:
-		c.Client.HSet(ctx, common.CartPre+session, item, count)
-	}
-}
-
-// CleanFullSession 清理包括购物车在内的会话
-func (c *Cache) CleanFullSession(ctx context.Context) {
-	// 如果退出了就不再执行
-	for !common.QUIT {
-		// 检查是否到达限制，如果未达限制则休眠再重新检查
-		size := c.Client.ZCard(ctx, common.Recent).Val()
-		if size <= common.LIMIT {
-			time.Sleep(1 * time.Second)
-			continue
-		}
-		// 一次最多删除一百条
-		endIndex := common.LIMIT
-		if size < endIndex {
-			endIndex = size
-		}
-		// 在最近访问中找出最早的一部分 token 记录
-		tokens := c.Client.ZRange(ctx, common.Recent, 0, endIndex-1).Val()
-
-		sessionKeys := make([]string, 0, len(tokens))
-		for _, token := range tokens {
-			sessionKeys = append(sessionKeys, common.ViewedPre+token)
-			sessionKeys = append(sessionKeys, common.CartPre+token)
-
-		}
-
-		c.Client.HDel(ctx, common.LoginHash, tokens...)
-		c.Client.ZRem(ctx, common.Recent, tokens)
-		c.Client.Del(ctx, sessionKeys...)
-
-	}
-
-	defer atomic.AddInt32(&common.FLAG, -1)
+// CleanSession 按 Eviction 配置分批淘汰会话，保留购物车，直到 ctx 取消
+func (c *Cache) CleanSession(ctx context.Context) error {
+	return c.evictLoop(ctx, false)
 }
 
-// CacheRequest 带缓存的请求处理
-func (c *Cache) CacheRequest(ctx context.Context, req string, callback func(string) string) string {
-	// 1. 判断该请求是否可以缓存，如果不行直接调用相应的处理函数
-	if !c.CanCache(ctx, req) {
-		return callback(req)
-	}
-	// 2. 如果可以缓存就返回缓存结果，如果缓存没有就处理后加入到缓存中
-	pageKey := common.ReqCachePre + req
-	content := c.Client.Get(ctx, pageKey).Val()
-
-	if content == "" {
-		res := callback(req)
-		c.Client.Set(ctx, pageKey, res, 300*time.Second)
-	}
-	return content
+// CleanFullSession 按 Eviction 配置分批淘汰包括购物车在内的会话，直到 ctx 取消
+func (c *Cache) CleanFullSession(ctx context.Context) error {
+	return c.evictLoop(ctx, true)
 }
 
 // CanCache 判断请求是否能够缓存
@@ -170,21 +144,28 @@ func (c *Cache) CanCache(ctx context.Context, req string) bool {
 	}
 
 	// 3. 判断该 item 是否在总的浏览过的商品中且是总浏览量前 10000
-	rank := c.Client.ZRank(ctx, common.Viewed, itemID).Val()
+	rank, err := c.Client.ZRank(ctx, common.Viewed, itemID).Result()
 
-	return rank != 0 && rank < 10000
+	return err == nil && rank < 10000
 }
 
+// extractItemId 提取请求查询参数中的 item，请求无法解析时返回空字符串
 func extractItemId(request string) string {
-	parsed, _ := url.Parse(request)
+	parsed, err := url.Parse(request)
+	if err != nil {
+		return ""
+	}
 	queryValue, _ := url.ParseQuery(parsed.RawQuery)
 	query := queryValue.Get("item")
 	return query
 }
 
 func isDynamic(req string) bool {
-	// 1. 将请求解析为结构体
-	parsed, _ := url.Parse(req)
+	// 1. 将请求解析为结构体，无法解析时视为不是动态请求，由 extractItemId 拒绝缓存
+	parsed, err := url.Parse(req)
+	if err != nil {
+		return false
+	}
 	// 2. 解析查询参数
 	queryValue, _ := url.ParseQuery(parsed.RawQuery)
 	// 3. 如果查询参数中有特定标记 _ 说明是动态的
@@ -204,50 +185,3 @@ func hashRequest(req string) string {
 	res := hash.Sum(nil)
 	return hex.EncodeToString(res)
 }
-
-// 调度有序集合和延迟哈希集合缓存
-func (c *Cache) ScheduleRowCache(ctx context.Context, rowID string, delay int64) {
-	c.Client.ZAdd(ctx, common.Schedule, redis.Z{
-		Score:  float64(time.Now().Unix() + delay),
-		Member: rowID,
-	})
-	c.Client.HSet(ctx, common.Schedule, rowID, delay)
-}
-
-func (c *Cache) CacheRows(ctx context.Context) {
-	for !common.QUIT {
-		// 得到下一次的更新缓存时间
-		next := c.Client.ZRangeWithScores(ctx, common.Schedule, 0, 0).Val()
-		now := time.Now().Unix()
-		if len(next) == 0 || next[0].Score > float64(now) {
-			time.Sleep(50 * time.Millisecond)
-			continue
-		}
-
-		rowID := next[0].Member.(string)
-		delayStr := c.Client.HGet(ctx, common.Delay, rowID).Val()
-		delay, _ := strconv.ParseFloat(delayStr, 10)
-
-		if delay <= 0 {
-			c.Client.ZRem(ctx, common.Schedule, rowID)
-			c.Client.HDel(ctx, common.Delay, rowID)
-			c.Client.Del(ctx, common.RowCachePre+rowID)
-			continue
-		}
-
-		row := c.GetDataFromDB(rowID)
-
-		c.Client.ZAdd(ctx, common.Schedule, redis.Z{Member: rowID, Score: float64(now) + delay})
-		jsonRow, err := json.Marshal(row)
-		if err != nil {
-			log.Fatalf("marshal json failed, data is: %v, err is: %v\n", row, err)
-		}
-		c.Client.Set(ctx, common.RowCachePre+rowID, jsonRow, 0)
-
-	}
-	defer atomic.AddInt32(&common.FLAG, -1)
-}
-
-func (c *Cache) GetDataFromDB(rowID string) string {
-	return "1111"
-}
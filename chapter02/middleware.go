@@ -0,0 +1,296 @@
+package chapter02
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/textproto"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"redis-practice/common"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+// cachedResponse 缓存的完整网页响应
+type cachedResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+	Stored int64       `json:"stored"`
+}
+
+// storeResponseScript 写入网页响应的一个变体，Vary 请求头列表改变时先删除按旧列表缓存的所有变体，
+// Vary 列表和变体集合的过期时间只延长不缩短，以覆盖其中最晚过期的变体。
+// 旧变体的 key 从变体集合中读取，未在 KEYS 中声明，不能用于 redis cluster
+//
+// KEYS: Vary 列表, 变体集合, 网页缓存
+// ARGV: Vary 列表, 网页响应, 毫秒过期时间
+var storeResponseScript = redis.NewScript(`
+local ttl = tonumber(ARGV[3])
+local old = redis.call('GET', KEYS[1])
+if old and old ~= ARGV[1] then
+	local variants = redis.call('SMEMBERS', KEYS[2])
+	for _, variant in ipairs(variants) do
+		redis.call('DEL', variant)
+	end
+	redis.call('DEL', KEYS[1], KEYS[2])
+end
+
+-- KEEPTTL 需要 6.0，先记下原有的过期时间
+local varyTTL = redis.call('PTTL', KEYS[1])
+redis.call('SET', KEYS[3], ARGV[2], 'PX', ttl)
+redis.call('SET', KEYS[1], ARGV[1], 'PX', math.max(varyTTL, ttl))
+redis.call('SADD', KEYS[2], KEYS[3])
+if redis.call('PTTL', KEYS[2]) < ttl then
+	redis.call('PEXPIRE', KEYS[2], ttl)
+end
+return 1
+`)
+
+// cacheableStatus 可以缓存的响应状态码
+var cacheableStatus = map[int]bool{
+	http.StatusOK:               true,
+	http.StatusMovedPermanently: true,
+	http.StatusNotFound:         true,
+	http.StatusGone:             true,
+}
+
+// Middleware 返回缓存整个网页响应的 http.Handler：只缓存 CanCache 判断可以缓存的 GET 请求，
+// 以规范化 URL 和响应 Vary 的请求头作为缓存 key，遵循请求和响应的 Cache-Control，
+// 并以 X-Cache: HIT / MISS 响应头标明是否命中。
+// 带 Authorization 的请求不读取缓存，其响应只有 Cache-Control 含 public 时才缓存
+func (c *Cache) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		reqDirectives := cacheControl(r.Header)
+		if r.Method != http.MethodGet || reqDirectives["no-store"] || !c.CanCache(ctx, r.URL.RequestURI()) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		urlHash := hashRequest(canonicalURL(r))
+		// 客户端要求 no-cache 时不读缓存，但仍以新的响应更新缓存
+		if !reqDirectives["no-cache"] && r.Header.Get("Authorization") == "" {
+			if cached := c.loadResponse(r, urlHash); cached != nil {
+				writeCachedResponse(w, cached)
+				return
+			}
+		}
+
+		w.Header().Set("X-Cache", "MISS")
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		c.storeResponse(r, urlHash, rec)
+	})
+}
+
+// loadResponse 读取请求对应的缓存响应，未命中时返回 nil
+func (c *Cache) loadResponse(r *http.Request, urlHash string) *cachedResponse {
+	ctx := r.Context()
+	vary := c.Client.Get(ctx, common.ReqVaryPre+urlHash).Val()
+	data, err := c.Client.Get(ctx, common.ReqCachePre+variantKey(urlHash, vary, r.Header)).Bytes()
+	if err != nil {
+		return nil
+	}
+
+	cached := &cachedResponse{}
+	if err := json.Unmarshal(data, cached); err != nil {
+		logrus.Errorf("unmarshal cached response %s failed, err: %v", r.URL, err)
+		return nil
+	}
+	return cached
+}
+
+// storeResponse 按响应的 Cache-Control 和 Vary 缓存响应
+func (c *Cache) storeResponse(r *http.Request, urlHash string, rec *responseRecorder) {
+	header := rec.Header().Clone()
+	header.Del("X-Cache")
+
+	ttl, ok := responseTTL(rec.status, header)
+	if !ok || rec.overflow {
+		return
+	}
+	// 共享缓存不能把需要认证的响应提供给其他用户，除非源站明确允许
+	if r.Header.Get("Authorization") != "" && !cacheControl(header)["public"] {
+		return
+	}
+	vary := varyHeaders(header)
+	if vary == "*" {
+		return
+	}
+
+	data, err := json.Marshal(&cachedResponse{
+		Status: rec.status,
+		Header: header,
+		Body:   rec.body.Bytes(),
+		Stored: time.Now().Unix(),
+	})
+	if err != nil {
+		logrus.Errorf("marshal response %s failed, err: %v", r.URL, err)
+		return
+	}
+
+	ctx := r.Context()
+	pageKey := common.ReqCachePre + variantKey(urlHash, vary, r.Header)
+	pipe := c.Client.TxPipeline()
+	storeResponseScript.Eval(ctx, pipe,
+		[]string{common.ReqVaryPre + urlHash, common.ReqVariantsPre + urlHash, pageKey},
+		vary, data, ttl.Milliseconds(),
+	)
+	indexPage(ctx, pipe, extractItemId(r.URL.RequestURI()), pageKey, ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		logrus.Errorf("cache response %s failed, err: %v", r.URL, err)
+	}
+}
+
+func writeCachedResponse(w http.ResponseWriter, cached *cachedResponse) {
+	header := w.Header()
+	for k, v := range cached.Header {
+		header[k] = v
+	}
+	header.Set("X-Cache", "HIT")
+	header.Set("Age", strconv.FormatInt(time.Now().Unix()-cached.Stored, 10))
+	w.WriteHeader(cached.Status)
+	w.Write(cached.Body)
+}
+
+// canonicalURL 规范化请求 URL：主机名小写，清理路径，查询参数按名称排序
+func canonicalURL(r *http.Request) string {
+	p := r.URL.Path
+	if p == "" {
+		p = "/"
+	}
+	cleaned := path.Clean(p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+
+	canonical := strings.ToLower(r.Host) + cleaned
+	if query := r.URL.Query(); len(query) != 0 {
+		for _, values := range query {
+			sort.Strings(values)
+		}
+		canonical += "?" + query.Encode()
+	}
+	return canonical
+}
+
+// variantKey 根据 Vary 的请求头取值计算缓存 key
+func variantKey(urlHash, vary string, header http.Header) string {
+	if vary == "" {
+		return urlHash
+	}
+	var b strings.Builder
+	b.WriteString(urlHash)
+	for _, name := range strings.Split(vary, ",") {
+		b.WriteString("\n")
+		b.WriteString(name)
+		b.WriteString(":")
+		b.WriteString(strings.Join(header.Values(name), ","))
+	}
+	return hashRequest(b.String())
+}
+
+// varyHeaders 返回规范化并排序后的 Vary 请求头列表，以逗号分隔，含 * 时返回 *
+func varyHeaders(header http.Header) string {
+	seen := make(map[string]bool)
+	names := make([]string, 0)
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return "*"
+			}
+			name = textproto.CanonicalMIMEHeaderKey(name)
+			if name != "" && !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// cacheControl 解析 Cache-Control 中的指令，带值的指令只记录名称
+func cacheControl(header http.Header) map[string]bool {
+	directives := make(map[string]bool)
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, _, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			directives[strings.ToLower(name)] = true
+		}
+	}
+	return directives
+}
+
+// responseTTL 根据状态码和响应头计算缓存时间，不能缓存时返回 false，
+// s-maxage 优先于 max-age，都没有时使用 common.ReqCacheSeconds
+func responseTTL(status int, header http.Header) (time.Duration, bool) {
+	if !cacheableStatus[status] || header.Get("Set-Cookie") != "" {
+		return 0, false
+	}
+
+	directives := cacheControl(header)
+	if directives["no-store"] || directives["no-cache"] || directives["private"] {
+		return 0, false
+	}
+
+	ttl := time.Duration(common.ReqCacheSeconds) * time.Second
+	for _, name := range []string{"s-maxage", "max-age"} {
+		if seconds, ok := directiveValue(header, name); ok {
+			ttl = time.Duration(seconds) * time.Second
+			break
+		}
+	}
+	return ttl, ttl > 0
+}
+
+func directiveValue(header http.Header, name string) (int64, bool) {
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			k, v, ok := strings.Cut(strings.TrimSpace(directive), "=")
+			if ok && strings.EqualFold(k, name) {
+				seconds, err := strconv.ParseInt(strings.Trim(v, `"`), 10, 64)
+				return seconds, err == nil
+			}
+		}
+	}
+	return 0, false
+}
+
+// responseRecorder 在写出响应的同时记录状态码和响应体
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+	// overflow 响应体超过 common.ReqCacheMaxBody，不再缓存
+	overflow bool
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status, rec.wroteHeader = status, true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	if !rec.overflow {
+		if rec.body.Len()+len(b) > common.ReqCacheMaxBody {
+			rec.overflow = true
+			rec.body.Reset()
+		} else {
+			rec.body.Write(b)
+		}
+	}
+	return rec.ResponseWriter.Write(b)
+}
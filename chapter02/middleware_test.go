@@ -0,0 +1,64 @@
+package chapter02
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanonicalURL(t *testing.T) {
+	a := httptest.NewRequest(http.MethodGet, "http://Shop.Example.com/a/../item/?b=2&item=1&b=1", nil)
+	b := httptest.NewRequest(http.MethodGet, "http://shop.example.com/item/?item=1&b=1&b=2", nil)
+	assert.Equal(t, "shop.example.com/item/?b=1&b=2&item=1", canonicalURL(a))
+	assert.Equal(t, canonicalURL(a), canonicalURL(b))
+}
+
+func TestExtractItemId(t *testing.T) {
+	// 带端口的 IP 主机名不是合法的相对 URL，解析失败时不能 panic
+	assert.Equal(t, "", extractItemId("10.0.0.1:8080/item?item=1"))
+	assert.False(t, isDynamic("10.0.0.1:8080/item?item=1&user=_1"))
+
+	req := httptest.NewRequest(http.MethodGet, "http://10.0.0.1:8080/item?item=1&user=_1", nil)
+	assert.Equal(t, "1", extractItemId(req.URL.RequestURI()))
+	assert.True(t, isDynamic(req.URL.RequestURI()))
+}
+
+func TestVaryHeaders(t *testing.T) {
+	header := http.Header{}
+	header.Add("Vary", "accept-encoding, Accept-Language")
+	header.Add("Vary", "Accept-Encoding")
+	assert.Equal(t, "Accept-Encoding,Accept-Language", varyHeaders(header))
+
+	header.Add("Vary", "*")
+	assert.Equal(t, "*", varyHeaders(header))
+
+	en := http.Header{"Accept-Language": {"en"}}
+	zh := http.Header{"Accept-Language": {"zh"}}
+	assert.Equal(t, "hash", variantKey("hash", "", en))
+	assert.NotEqual(t, variantKey("hash", "Accept-Language", en), variantKey("hash", "Accept-Language", zh))
+}
+
+func TestResponseTTL(t *testing.T) {
+	ttl, ok := responseTTL(http.StatusOK, http.Header{})
+	assert.True(t, ok)
+	assert.Equal(t, 300*time.Second, ttl)
+
+	ttl, ok = responseTTL(http.StatusOK, http.Header{"Cache-Control": {"public, max-age=60, s-maxage=\"30\""}})
+	assert.True(t, ok)
+	assert.Equal(t, 30*time.Second, ttl)
+
+	for _, header := range []http.Header{
+		{"Cache-Control": {"private"}},
+		{"Cache-Control": {"no-store"}},
+		{"Cache-Control": {"max-age=0"}},
+		{"Set-Cookie": {"a=b"}},
+	} {
+		_, ok = responseTTL(http.StatusOK, header)
+		assert.False(t, ok, header)
+	}
+	_, ok = responseTTL(http.StatusInternalServerError, http.Header{})
+	assert.False(t, ok)
+}
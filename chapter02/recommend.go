@@ -0,0 +1,177 @@
+package chapter02
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"redis-practice/common"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// coViewScript 商品第一次出现在会话的浏览记录中时，与会话中其他商品互相增加一次共同浏览，同时丢弃会话已汇总的推荐。
+// 每个商品的共同浏览超过 common.CoViewedMax 个时，移除分值低于第 CoViewedMax 名的商品，
+// 与其同分的商品都保留，使新出现的商品不会因同分时的成员顺序被随意淘汰，最多保留 2 倍 CoViewedMax 个
+//
+// KEYS: 会话浏览记录, 有共同浏览记录的商品集合, 会话推荐, 商品的共同浏览, 其他商品的共同浏览...
+// ARGV: 商品, 最大共同浏览商品数, 其他商品...
+var coViewScript = redis.NewScript(`
+if redis.call('ZSCORE', KEYS[1], ARGV[1]) then
+	return 0
+end
+
+local max = tonumber(ARGV[2])
+local function trim(key)
+	local n = redis.call('ZCARD', key) - max
+	if n <= 0 then
+		return
+	end
+	-- 第 CoViewedMax 名的分值
+	local floor = redis.call('ZRANGE', key, n, n, 'WITHSCORES')[2]
+	redis.call('ZREMRANGEBYSCORE', key, '-inf', '(' .. floor)
+	redis.call('ZREMRANGEBYRANK', key, 0, -2 * max - 1)
+end
+
+for i = 3, #ARGV do
+	local key = KEYS[i + 2]
+	redis.call('ZINCRBY', KEYS[4], 1, ARGV[i])
+	redis.call('ZINCRBY', key, 1, ARGV[1])
+	trim(key)
+	redis.call('SADD', KEYS[2], ARGV[i])
+end
+if #ARGV > 2 then
+	trim(KEYS[4])
+	redis.call('SADD', KEYS[2], ARGV[1])
+	redis.call('DEL', KEYS[3])
+end
+return #ARGV - 2
+`)
+
+// recordCoViews 记录商品与会话中之前浏览过的商品的共同浏览，
+// 先读出会话浏览过的商品，以便在脚本的 KEYS 中声明它们的共同浏览有序集合
+func (c *Cache) recordCoViews(ctx context.Context, token, item string) error {
+	viewed, err := c.Client.ZRange(ctx, common.ViewedPre+token, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+
+	keys := []string{common.ViewedPre + token, common.CoViewedItems, common.CoViewedSessionPre + token, common.CoViewedPre + item}
+	args := []any{item, common.CoViewedMax}
+	for _, other := range viewed {
+		if other != item {
+			keys = append(keys, common.CoViewedPre+other)
+			args = append(args, other)
+		}
+	}
+	return coViewScript.Run(ctx, c.Client, keys, args...).Err()
+}
+
+// rescaleCoViews 将所有共同浏览分值减半，移除低于 common.CoViewedMinScore 的商品，使推荐偏向近期的浏览
+func (c *Cache) rescaleCoViews(ctx context.Context) error {
+	minScore := "(" + strconv.FormatFloat(common.CoViewedMinScore, 'f', -1, 64)
+
+	var cursor uint64
+	for {
+		items, next, err := c.Client.SScan(ctx, common.CoViewedItems, cursor, "", 1000).Result()
+		if err != nil {
+			return err
+		}
+
+		cardCmds := make([]*redis.IntCmd, len(items))
+		_, err = c.Client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, item := range items {
+				key := common.CoViewedPre + item
+				pipe.ZInterStore(ctx, key, &redis.ZStore{Keys: []string{key}, Weights: []float64{0.5}})
+				pipe.ZRemRangeByScore(ctx, key, "-inf", minScore)
+				cardCmds[i] = pipe.ZCard(ctx, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// 已没有共同浏览商品的商品不再参与衰减
+		empty := make([]any, 0)
+		for i, cmd := range cardCmds {
+			if cmd.Val() == 0 {
+				empty = append(empty, items[i])
+			}
+		}
+		if len(empty) != 0 {
+			if err := c.Client.SRem(ctx, common.CoViewedItems, empty...).Err(); err != nil {
+				return err
+			}
+		}
+
+		if cursor = next; cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// RelatedItems 返回与商品共同浏览次数最多的至多 n 个商品
+func (c *Cache) RelatedItems(ctx context.Context, item string, n int64) ([]string, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	return c.Client.ZRevRange(ctx, common.CoViewedPre+item, 0, n-1).Result()
+}
+
+// RecommendForSession 按会话最近浏览的商品汇总共同浏览，返回至多 n 个会话未浏览过的商品，
+// 越近浏览的商品权重越高；会话没有浏览记录时返回最热门的商品
+func (c *Cache) RecommendForSession(ctx context.Context, token string, n int64) ([]string, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+
+	viewed, err := c.Client.ZRevRange(ctx, common.ViewedPre+token, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(viewed) == 0 {
+		// 商品总浏览数的分值为负，排名越前浏览越多
+		return c.Client.ZRange(ctx, common.Viewed, 0, n-1).Result()
+	}
+
+	cacheKey := common.CoViewedSessionPre + token
+	if c.Client.Exists(ctx, cacheKey).Val() == 0 {
+		keys := make([]string, 0, len(viewed))
+		weights := make([]float64, 0, len(viewed))
+		for i, item := range viewed {
+			keys = append(keys, common.CoViewedPre+item)
+			weights = append(weights, 1/float64(i+1))
+		}
+
+		_, err := c.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.ZUnionStore(ctx, cacheKey, &redis.ZStore{Keys: keys, Weights: weights})
+			pipe.Expire(ctx, cacheKey, common.CoViewedSessionSeconds*time.Second)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// 多取已浏览的商品数，过滤后仍能凑够 n 个
+	candidates, err := c.Client.ZRevRange(ctx, cacheKey, 0, n+int64(len(viewed))-1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool, len(viewed))
+	for _, item := range viewed {
+		seen[item] = true
+	}
+	items := make([]string, 0, n)
+	for _, item := range candidates {
+		if int64(len(items)) == n {
+			break
+		}
+		if !seen[item] {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
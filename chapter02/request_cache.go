@@ -0,0 +1,191 @@
+package chapter02
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"math/rand"
+	"time"
+
+	"redis-practice/common"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+// RequestCacheConfig 网页请求缓存配置
+type RequestCacheConfig struct {
+	// TTL 缓存内容的有效期
+	TTL time.Duration
+	// StaleTTL 内容过期后仍可直接返回旧内容、同时在后台重新生成的时间
+	StaleTTL time.Duration
+	// LockTTL 重新生成内容时锁的过期时间，也是其他节点等待生成结果的最长时间
+	LockTTL time.Duration
+	// RefreshTimeout 后台重新生成内容的超时时间，超时后不再写入缓存，0 表示不限制
+	RefreshTimeout time.Duration
+	// Beta 提前过期的系数，越大越倾向于在过期前提前刷新，0 表示不提前刷新
+	Beta float64
+	// NearCache 为 true 时通过 Client 的近端缓存读取缓存内容，需要先调用 Client.EnableNearCache
+	NearCache bool
+}
+
+func DefaultRequestCacheConfig() *RequestCacheConfig {
+	return &RequestCacheConfig{
+		TTL:            common.ReqCacheSeconds * time.Second,
+		StaleTTL:       time.Minute,
+		LockTTL:        5 * time.Second,
+		RefreshTimeout: 30 * time.Second,
+		Beta:           1,
+	}
+}
+
+// requestEntry 缓存的请求内容
+type requestEntry struct {
+	Value string `json:"value"`
+	// Expiry 内容过期的毫秒时间戳
+	Expiry int64 `json:"expiry"`
+	// Delta 生成内容所用的毫秒数，用于计算提前过期
+	Delta int64 `json:"delta"`
+}
+
+// expired 判断内容是否需要重新生成：已过期，或按生成耗时和 beta 以一定概率提前过期，
+// 生成越慢、离过期越近，越可能提前刷新，使热点内容在过期前就由单个调用方刷新
+func (e *requestEntry) expired(now time.Time, beta float64) bool {
+	early := float64(e.Delta) * beta * -math.Log(1-rand.Float64())
+	return float64(now.UnixMilli())+early >= float64(e.Expiry)
+}
+
+// unlockScript 只释放自己持有的锁
+var unlockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+func (c *Cache) requestCache() *RequestCacheConfig {
+	if c.RequestCache == nil {
+		return DefaultRequestCacheConfig()
+	}
+	return c.RequestCache
+}
+
+// CacheRequest 带缓存的请求处理：内容需要刷新时先返回旧内容并在后台重新生成，
+// 没有缓存时本进程内的并发调用合并为一次生成，多个节点之间由锁保证只有一个节点生成
+func (c *Cache) CacheRequest(ctx context.Context, req string, callback func(string) string) string {
+	// 1. 判断该请求是否可以缓存，如果不行直接调用相应的处理函数
+	if !c.CanCache(ctx, req) {
+		return callback(req)
+	}
+
+	// 2. 有缓存时直接返回，需要刷新时在后台重新生成
+	cfg := c.requestCache()
+	if entry := c.loadRequest(ctx, req); entry != nil {
+		if entry.expired(time.Now(), cfg.Beta) {
+			c.refreshRequest(req, callback)
+		}
+		return entry.Value
+	}
+
+	// 3. 没有缓存时生成内容并加入到缓存中
+	res, _, _ := c.flight.Do(req, func() (any, error) {
+		return c.generateRequest(ctx, req, callback, true), nil
+	})
+	return res.(string)
+}
+
+// refreshRequest 在后台重新生成内容，同一请求同时只有一个后台刷新
+func (c *Cache) refreshRequest(req string, callback func(string) string) {
+	cfg := c.requestCache()
+	c.flight.DoChan("refresh:"+req, func() (any, error) {
+		ctx := context.Background()
+		if cfg.RefreshTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, cfg.RefreshTimeout)
+			defer cancel()
+		}
+		return c.generateRequest(ctx, req, callback, false), nil
+	})
+}
+
+// generateRequest 获取锁后生成内容并写入缓存，其他节点正在生成时，
+// wait 为 true 则等待其结果，等待超时后自行生成，wait 为 false 则直接返回
+func (c *Cache) generateRequest(ctx context.Context, req string, callback func(string) string, wait bool) string {
+	cfg := c.requestCache()
+	lockKey := common.ReqLockPre + req
+
+	lockToken, err := newToken()
+	if err != nil {
+		return callback(req)
+	}
+	locked, err := c.Client.SetNX(ctx, lockKey, lockToken, cfg.LockTTL).Result()
+	if err == nil && !locked {
+		if !wait {
+			return ""
+		}
+		if entry := c.waitRequest(ctx, req, cfg.LockTTL); entry != nil {
+			return entry.Value
+		}
+	}
+	if locked {
+		defer unlockScript.Run(ctx, c.Client, []string{lockKey}, lockToken)
+	}
+
+	start := time.Now()
+	res := callback(req)
+	c.storeRequest(ctx, req, res, time.Since(start), cfg)
+	return res
+}
+
+// waitRequest 等待其他节点写入缓存，超时返回 nil
+func (c *Cache) waitRequest(ctx context.Context, req string, timeout time.Duration) *requestEntry {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if common.SleepContext(ctx, 50*time.Millisecond) != nil {
+			return nil
+		}
+		if entry := c.loadRequest(ctx, req); entry != nil {
+			return entry
+		}
+	}
+	return nil
+}
+
+func (c *Cache) loadRequest(ctx context.Context, req string) *requestEntry {
+	var data string
+	var err error
+	if c.requestCache().NearCache {
+		data, err = c.Client.CachedGet(ctx, common.ReqCachePre+req)
+	} else {
+		data, err = c.Client.Get(ctx, common.ReqCachePre+req).Result()
+	}
+	if err != nil {
+		return nil
+	}
+	entry := &requestEntry{}
+	if err := json.Unmarshal([]byte(data), entry); err != nil {
+		return nil
+	}
+	return entry
+}
+
+// storeRequest 写入缓存，redis 中保留到过期后 StaleTTL 以便返回旧内容
+func (c *Cache) storeRequest(ctx context.Context, req, value string, delta time.Duration, cfg *RequestCacheConfig) {
+	data, err := json.Marshal(&requestEntry{
+		Value:  value,
+		Expiry: time.Now().Add(cfg.TTL).UnixMilli(),
+		Delta:  delta.Milliseconds(),
+	})
+	if err != nil {
+		logrus.Errorf("marshal request %s failed, err: %v", req, err)
+		return
+	}
+	_, err = c.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, common.ReqCachePre+req, data, cfg.TTL+cfg.StaleTTL)
+		indexPage(ctx, pipe, extractItemId(req), common.ReqCachePre+req, cfg.TTL+cfg.StaleTTL)
+		return nil
+	})
+	if err != nil {
+		logrus.Errorf("cache request %s failed, err: %v", req, err)
+	}
+}
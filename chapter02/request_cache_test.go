@@ -0,0 +1,26 @@
+package chapter02
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestEntryExpired(t *testing.T) {
+	now := time.Now()
+	entry := &requestEntry{Expiry: now.Add(time.Minute).UnixMilli(), Delta: 10}
+	assert.False(t, entry.expired(now, 0))
+	assert.False(t, entry.expired(now, 1), "fast pages far from expiry should not refresh early")
+	assert.True(t, entry.expired(now.Add(time.Minute), 0))
+
+	// 生成耗时接近剩余有效期时大多会提前刷新
+	slow := &requestEntry{Expiry: now.Add(time.Second).UnixMilli(), Delta: 10000}
+	early := 0
+	for i := 0; i < 100; i++ {
+		if slow.expired(now, 1) {
+			early++
+		}
+	}
+	assert.Greater(t, early, 80)
+}
@@ -0,0 +1,155 @@
+package chapter02
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"redis-practice/common"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+// RowSource 数据行缓存的数据来源，通常是数据库
+type RowSource interface {
+	// GetRows 批量读取数据行，结果以行 id 为 key，不存在的行不包含在结果中
+	GetRows(ctx context.Context, rowIDs []string) (map[string]any, error)
+}
+
+// ErrNoRowSource 未设置 Cache.RowSource
+var ErrNoRowSource = errors.New("row source not set")
+
+func (c *Cache) rowCodec() RowCodec {
+	if c.RowCodec == nil {
+		return JSONCodec
+	}
+	return c.RowCodec
+}
+
+// ScheduleRowCache 设置数据行每 delay 秒刷新一次缓存并立即安排刷新，delay <= 0 时下次调度会删除该行的缓存
+func (c *Cache) ScheduleRowCache(ctx context.Context, rowID string, delay int64) error {
+	_, err := c.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, common.Delay, rowID, delay)
+		pipe.ZAdd(ctx, common.Schedule, redis.Z{Score: float64(time.Now().Unix()), Member: rowID})
+		return nil
+	})
+	return err
+}
+
+// CacheRows 定期刷新到期的数据行缓存，直到 ctx 取消，
+// 数据源或 redis 出错时记录日志并以指数退避重试，不会退出
+func (c *Cache) CacheRows(ctx context.Context) error {
+	if c.RowSource == nil {
+		return ErrNoRowSource
+	}
+	backoff := time.Second
+	for {
+		refreshed, err := c.RefreshRows(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			logrus.Errorf("refresh rows failed, retry after %v, err: %v", backoff, err)
+			if err := common.SleepContext(ctx, backoff); err != nil {
+				return err
+			}
+			if backoff *= 2; backoff > time.Minute {
+				backoff = time.Minute
+			}
+			continue
+		}
+		backoff = time.Second
+
+		// 一批没有处理满说明暂时没有到期的数据行，休眠再重新检查
+		if refreshed < common.RowCacheBatch {
+			if err := common.SleepContext(ctx, 50*time.Millisecond); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// RefreshRows 刷新一批到期的数据行缓存，返回处理的行数
+func (c *Cache) RefreshRows(ctx context.Context) (int, error) {
+	if c.RowSource == nil {
+		return 0, ErrNoRowSource
+	}
+
+	now := time.Now().Unix()
+	rowIDs, err := c.Client.ZRangeByScore(ctx, common.Schedule, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now, 10),
+		Count: common.RowCacheBatch,
+	}).Result()
+	if err != nil || len(rowIDs) == 0 {
+		return 0, err
+	}
+
+	delays, err := c.Client.HMGet(ctx, common.Delay, rowIDs...).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	// 延迟不大于 0 的数据行不再缓存
+	live := make([]string, 0, len(rowIDs))
+	liveDelays := make(map[string]int64, len(rowIDs))
+	var removed []string
+	for i, rowID := range rowIDs {
+		delay, _ := delays[i].(string)
+		if d, _ := strconv.ParseInt(delay, 10, 64); d > 0 {
+			live = append(live, rowID)
+			liveDelays[rowID] = d
+			continue
+		}
+		removed = append(removed, rowID)
+	}
+
+	var rows map[string]any
+	if len(live) != 0 {
+		if rows, err = c.RowSource.GetRows(ctx, live); err != nil {
+			return 0, err
+		}
+	}
+
+	codec := c.rowCodec()
+	_, err = c.Client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		// 编码失败的行保留原有缓存并照常重新调度，不影响同一批的其他行
+		for _, rowID := range removed {
+			pipe.ZRem(ctx, common.Schedule, rowID)
+			pipe.HDel(ctx, common.Delay, rowID)
+			pipe.Del(ctx, common.RowCachePre+rowID)
+		}
+		for _, rowID := range live {
+			// 数据源中已不存在的行删除缓存，但仍按调度检查，之后出现时会重新缓存
+			if row, ok := rows[rowID]; ok {
+				if data, err := codec.Marshal(row); err != nil {
+					logrus.Errorf("marshal row %s failed, err: %v", rowID, err)
+				} else {
+					pipe.Set(ctx, common.RowCachePre+rowID, data, 0)
+				}
+			} else {
+				pipe.Del(ctx, common.RowCachePre+rowID)
+			}
+			pipe.ZAdd(ctx, common.Schedule, redis.Z{Score: float64(now + liveDelays[rowID]), Member: rowID})
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(rowIDs), nil
+}
+
+// GetCachedRow 将缓存的数据行解码到 v，没有缓存时返回 false
+func (c *Cache) GetCachedRow(ctx context.Context, rowID string, v any) (bool, error) {
+	data, err := c.Client.Get(ctx, common.RowCachePre+rowID).Bytes()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, c.rowCodec().Unmarshal(data, v)
+}
@@ -0,0 +1,245 @@
+package chapter02
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"redis-practice/common"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// tokenBytes 签发 token 的随机字节数
+const tokenBytes = 32
+
+// ClientInfo 登录的客户端信息，用于将 token 绑定到客户端，为空的字段不参与绑定
+type ClientInfo struct {
+	IP        string
+	UserAgent string
+}
+
+// binding 返回保存在 common.LoginBinding 中的绑定值，格式为 ip|User-Agent 摘要
+func (ci *ClientInfo) binding() string {
+	if ci == nil || (ci.IP == "" && ci.UserAgent == "") {
+		return ""
+	}
+	return ci.IP + "|" + hashUserAgent(ci.UserAgent)
+}
+
+// matches 判断客户端是否与绑定值一致
+func (ci *ClientInfo) matches(binding string) bool {
+	ip, ua, _ := strings.Cut(binding, "|")
+	if ip != "" && ip != ci.IP {
+		return false
+	}
+	return ua == "" || ua == hashUserAgent(ci.UserAgent)
+}
+
+func hashUserAgent(ua string) string {
+	if ua == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(ua))
+	return hex.EncodeToString(sum[:])
+}
+
+// newToken 生成密码学安全的随机 token
+func newToken() (string, error) {
+	b := make([]byte, tokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Login 为用户签发新 token，client 不为 nil 时将 token 绑定到该客户端
+func (c *Cache) Login(ctx context.Context, user string, client *ClientInfo) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = c.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, common.LoginHash, token, user)
+		pipe.ZAdd(ctx, common.Recent, redis.Z{Score: float64(time.Now().Unix()), Member: token})
+		pipe.SAdd(ctx, common.UserTokensPre+user, token)
+		binding := client.binding()
+		if binding != "" {
+			pipe.HSet(ctx, common.LoginBinding, token, binding)
+		}
+		if c.NearCacheSessions {
+			// binding 为空时也写入，使近端缓存能缓存未绑定的结果
+			pipe.HSet(ctx, common.SessionPre+token, "user", user, "binding", binding)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Logout 注销 token 并删除其会话数据
+func (c *Cache) Logout(ctx context.Context, token string) error {
+	user, err := c.Client.HGet(ctx, common.LoginHash, token).Result()
+	if err == redis.Nil {
+		return ErrInvalidToken
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		removeSession(ctx, pipe, user, token)
+		return nil
+	})
+	return err
+}
+
+// RevokeAllSessions 注销用户的所有 token，返回注销的 token 数
+func (c *Cache) RevokeAllSessions(ctx context.Context, user string) (int, error) {
+	tokens, err := c.Client.SMembers(ctx, common.UserTokensPre+user).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = c.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, token := range tokens {
+			removeSession(ctx, pipe, user, token)
+		}
+		pipe.Del(ctx, common.UserTokensPre+user)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(tokens), nil
+}
+
+// rotateScript 原子地将会话从旧 token 转移到新 token
+//
+// KEYS: login, recent, 用户 token 集合, login-binding, 旧浏览记录, 新浏览记录, 旧购物车, 新购物车, 旧会话哈希, 新会话哈希
+// ARGV: 旧 token, 新 token, 用户, 当前时间
+var rotateScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], ARGV[1]) ~= ARGV[3] then
+	return 0
+end
+redis.call('HDEL', KEYS[1], ARGV[1])
+redis.call('HSET', KEYS[1], ARGV[2], ARGV[3])
+redis.call('ZREM', KEYS[2], ARGV[1])
+redis.call('ZADD', KEYS[2], ARGV[4], ARGV[2])
+redis.call('SREM', KEYS[3], ARGV[1])
+redis.call('SADD', KEYS[3], ARGV[2])
+local binding = redis.call('HGET', KEYS[4], ARGV[1])
+if binding then
+	redis.call('HDEL', KEYS[4], ARGV[1])
+	redis.call('HSET', KEYS[4], ARGV[2], binding)
+end
+if redis.call('EXISTS', KEYS[5]) == 1 then
+	redis.call('RENAME', KEYS[5], KEYS[6])
+end
+if redis.call('EXISTS', KEYS[7]) == 1 then
+	redis.call('RENAME', KEYS[7], KEYS[8])
+end
+if redis.call('EXISTS', KEYS[9]) == 1 then
+	redis.call('RENAME', KEYS[9], KEYS[10])
+end
+return 1
+`)
+
+// RotateToken 为已登录的会话签发新 token 并使旧 token 失效，浏览记录、购物车和客户端绑定随之转移，
+// 用户权限变化（如提权、修改密码）时应调用以防止会话固定攻击
+func (c *Cache) RotateToken(ctx context.Context, token string) (string, error) {
+	user := c.Client.HGet(ctx, common.LoginHash, token).Val()
+	if user == "" {
+		return "", ErrInvalidToken
+	}
+	newTok, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	res, err := rotateScript.Run(ctx, c.Client,
+		[]string{
+			common.LoginHash, common.Recent, common.UserTokensPre + user, common.LoginBinding,
+			common.ViewedPre + token, common.ViewedPre + newTok, common.CartPre + token, common.CartPre + newTok,
+			common.SessionPre + token, common.SessionPre + newTok,
+		},
+		token, newTok, user, time.Now().Unix(),
+	).Int()
+	if err != nil {
+		return "", err
+	}
+	if res == 0 {
+		return "", ErrInvalidToken
+	}
+	return newTok, nil
+}
+
+// mergeScript 将匿名会话的购物车和浏览记录合并到登录会话并删除匿名会话，
+// 返回 0 表示登录 token 未登录或匿名 token 已登录
+//
+// KEYS: 匿名购物车, 登录购物车, 匿名浏览记录, 登录浏览记录, login, recent
+// ARGV: 登录 token, 匿名 token, 购物车最大数量, 最近浏览商品数
+var mergeScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[5], ARGV[1]) == 0 or redis.call('HEXISTS', KEYS[5], ARGV[2]) == 1 then
+	return 0
+end
+
+local max = tonumber(ARGV[3])
+local items = redis.call('HGETALL', KEYS[1])
+for i = 1, #items, 2 do
+	local quantity = tonumber(items[i + 1]) + tonumber(redis.call('HGET', KEYS[2], items[i]) or '0')
+	if quantity > max then
+		quantity = max
+	end
+	redis.call('HSET', KEYS[2], items[i], quantity)
+end
+
+-- 分值为浏览时间，同一商品保留较晚的一次
+redis.call('ZUNIONSTORE', KEYS[4], 2, KEYS[4], KEYS[3], 'AGGREGATE', 'MAX')
+redis.call('ZREMRANGEBYRANK', KEYS[4], 0, -tonumber(ARGV[4]) - 1)
+
+redis.call('DEL', KEYS[1], KEYS[3])
+redis.call('ZREM', KEYS[6], ARGV[2])
+return 1
+`)
+
+// MergeSession 登录后将匿名会话合并到登录会话：购物车中商品数量相加（不超过 common.CartMaxQuantity），
+// 浏览记录合并后保留最近的 common.ViewedMax 个，之后删除匿名会话的数据，
+// userToken 未登录或 anonToken 已登录时返回 ErrInvalidToken
+func (c *Cache) MergeSession(ctx context.Context, anonToken, userToken string) error {
+	if anonToken == userToken {
+		return nil
+	}
+
+	res, err := mergeScript.Run(ctx, c.Client,
+		[]string{
+			common.CartPre + anonToken, common.CartPre + userToken,
+			common.ViewedPre + anonToken, common.ViewedPre + userToken,
+			common.LoginHash, common.Recent,
+		},
+		userToken, anonToken, common.CartMaxQuantity, common.ViewedMax,
+	).Int()
+	if err != nil {
+		return err
+	}
+	if res == 0 {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// removeSession 在流水线中删除 token 的登录信息和会话数据，会话哈希不论是否开启近端缓存都删除
+func removeSession(ctx context.Context, pipe redis.Pipeliner, user, token string) {
+	pipe.HDel(ctx, common.LoginHash, token)
+	pipe.HDel(ctx, common.LoginBinding, token)
+	pipe.Del(ctx, common.SessionPre+token)
+	pipe.ZRem(ctx, common.Recent, token)
+	pipe.SRem(ctx, common.UserTokensPre+user, token)
+	pipe.Del(ctx, common.ViewedPre+token, common.CartPre+token)
+}
@@ -0,0 +1,29 @@
+package chapter02
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewToken(t *testing.T) {
+	first, err := newToken()
+	assert.Nil(t, err)
+	second, _ := newToken()
+	assert.Len(t, first, tokenBytes*2)
+	assert.NotEqual(t, first, second, "tokens should be random")
+}
+
+func TestClientBinding(t *testing.T) {
+	var unbound *ClientInfo
+	assert.Equal(t, "", unbound.binding())
+
+	client := &ClientInfo{IP: "10.0.0.1", UserAgent: "Mozilla/5.0"}
+	binding := client.binding()
+	assert.True(t, client.matches(binding))
+	assert.False(t, (&ClientInfo{IP: "10.0.0.2", UserAgent: "Mozilla/5.0"}).matches(binding), "ip should be checked")
+	assert.False(t, (&ClientInfo{IP: "10.0.0.1", UserAgent: "curl/8.0"}).matches(binding), "user agent should be checked")
+
+	ipOnly := (&ClientInfo{IP: "10.0.0.1"}).binding()
+	assert.True(t, (&ClientInfo{IP: "10.0.0.1", UserAgent: "curl/8.0"}).matches(ipOnly), "unbound fields should be ignored")
+}
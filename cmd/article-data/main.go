@@ -0,0 +1,104 @@
+// article-data 以 JSON Lines 格式导出或导入第一章的文章数据
+//
+//	article-data export -o articles.jsonl
+//	article-data import -i articles.jsonl -skip-existing
+//	article-data import -i articles.jsonl -overwrite
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"redis-practice"
+	"redis-practice/chapter01"
+	"redis-practice/common"
+
+	"github.com/sirupsen/logrus"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	fs := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	addr := fs.String("redis-addr", redis_practice.Addr, "redis address")
+	password := fs.String("redis-password", redis_practice.Password, "redis password")
+	db := fs.Int("redis-db", redis_practice.DB, "redis database")
+
+	ctx := context.Background()
+	switch os.Args[1] {
+	case "export":
+		output := fs.String("o", "-", "output file, - for stdout")
+		_ = fs.Parse(os.Args[2:])
+
+		w := io.Writer(os.Stdout)
+		if *output != "-" {
+			f, err := os.Create(*output)
+			if err != nil {
+				logrus.Fatal("create output file failed, err: ", err)
+			}
+			defer f.Close()
+			w = f
+		}
+
+		n, err := connect(ctx, *addr, *password, *db).Export(ctx, w)
+		if err != nil {
+			logrus.Fatal("export failed, err: ", err)
+		}
+		logrus.Infof("exported %d keys", n)
+
+	case "import":
+		input := fs.String("i", "-", "input file, - for stdin")
+		overwrite := fs.Bool("overwrite", false, "overwrite existing keys")
+		skipExisting := fs.Bool("skip-existing", false, "skip existing keys (default)")
+		_ = fs.Parse(os.Args[2:])
+
+		if *overwrite && *skipExisting {
+			logrus.Fatal("-overwrite and -skip-existing are mutually exclusive")
+		}
+		mode := chapter01.ImportSkipExisting
+		if *overwrite {
+			mode = chapter01.ImportOverwrite
+		}
+
+		r := io.Reader(os.Stdin)
+		if *input != "-" {
+			f, err := os.Open(*input)
+			if err != nil {
+				logrus.Fatal("open input file failed, err: ", err)
+			}
+			defer f.Close()
+			r = f
+		}
+
+		stats, err := connect(ctx, *addr, *password, *db).Import(ctx, r, mode)
+		if err != nil {
+			logrus.Fatalf("import failed after %d keys, err: %v", stats.Imported, err)
+		}
+		logrus.Infof("imported %d keys, skipped %d existing keys", stats.Imported, stats.Skipped)
+
+	default:
+		usage()
+	}
+}
+
+func connect(ctx context.Context, addr, password string, db int) *chapter01.ArticleRepo {
+	conn := common.ConnectRedis(ctx, &common.RedisConf{
+		Addr:     addr,
+		Password: password,
+		DB:       db,
+	})
+	if conn == nil {
+		logrus.Fatal("connect redis failed")
+	}
+	return chapter01.NewArticleRepo(common.NewClient(conn))
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: article-data export [-o file] | import [-i file] [-overwrite | -skip-existing]")
+	os.Exit(2)
+}
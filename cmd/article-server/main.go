@@ -0,0 +1,79 @@
+// article-server 以 HTTP JSON 接口运行第一章的文章投票系统
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"redis-practice"
+	"redis-practice/chapter01"
+	"redis-practice/chapter01/api"
+	"redis-practice/chapter01/service"
+	"redis-practice/common"
+
+	"github.com/sirupsen/logrus"
+)
+
+func main() {
+	listen := flag.String("listen", ":8080", "http listen address")
+	addr := flag.String("redis-addr", redis_practice.Addr, "redis address")
+	password := flag.String("redis-password", redis_practice.Password, "redis password")
+	db := flag.Int("redis-db", redis_practice.DB, "redis database")
+	flag.Parse()
+
+	ctx := context.Background()
+	conn := common.ConnectRedis(ctx, &common.RedisConf{
+		Addr:     *addr,
+		Password: *password,
+		DB:       *db,
+	})
+	if conn == nil {
+		logrus.Fatal("connect redis failed")
+	}
+	defer conn.Close()
+
+	repo := chapter01.NewArticleRepo(common.NewClient(conn))
+
+	// 后台任务在收到退出信号后随 supervisor 一起停止
+	supervisor := common.NewSupervisor(ctx)
+	for name, job := range map[string]common.Job{
+		"refresh-ranks":           repo.RefreshRanks,
+		"archive-expired":         repo.ArchiveExpired,
+		"refresh-recommendations": repo.RefreshRecommendations,
+	} {
+		if err := supervisor.Go(name, job); err != nil {
+			logrus.Fatal("start job failed, err: ", err)
+		}
+	}
+
+	server := &http.Server{
+		Addr:    *listen,
+		Handler: api.NewServer(service.NewArticleService(repo)),
+	}
+
+	go func() {
+		logrus.Info("article server listening on ", *listen)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.Fatal("article server failed, err: ", err)
+		}
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logrus.Error("article server shutdown failed, err: ", err)
+	}
+	if err := supervisor.Shutdown(10 * time.Second); err != nil {
+		logrus.Error("background jobs shutdown failed, err: ", err)
+	}
+}
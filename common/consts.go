@@ -6,14 +6,110 @@ const (
 
 	// article id 集合
 	ArticleID = "article-id"
-	// 已投票集合前缀
+	// 已投票（赞成票）集合前缀
 	VotedSetPre = "voted-set:"
+	// 已投反对票集合前缀
+	DownVotedSetPre = "down-voted-set:"
 	// article 哈希集合前缀
 	ArticleHashSetPre = "article-hash-set:"
 	// article 得分有序集合
 	Score = "score"
 	// article 时间有序集合
 	Time = "time"
+	// article 时间衰减热度有序集合
+	Hot = "hot"
+	// article 净票数有序集合
+	Votes = "votes"
+	// article Wilson 得分有序集合
+	Best = "best"
+	// comment id 集合
+	CommentID = "comment-id"
+	// comment 哈希集合前缀
+	CommentHashSetPre = "comment-hash-set:"
+	// comment 已投票（赞成票）集合前缀
+	CommentVotedSetPre = "comment-voted-set:"
+	// comment 已投反对票集合前缀
+	CommentDownVotedSetPre = "comment-down-voted-set:"
+	// 文章所有评论 id 集合前缀
+	ArticleCommentsPre = "article-comments:"
+	// 同一父评论下按时间排序的回复有序集合前缀，完整 key 为 comment-new:<文章 id>:<父评论 id>
+	CommentNewPre = "comment-new:"
+	// 同一父评论下按净票数排序的回复有序集合前缀，完整 key 为 comment-top:<文章 id>:<父评论 id>
+	CommentTopPre = "comment-top:"
+	// 直接回复文章的评论的父评论 id
+	RootCommentID = "0"
+	// 最新评论排序
+	CommentNew = "new"
+	// 最高票评论排序
+	CommentTop = "top"
+
+	// 文章事件 stream
+	ArticleEvents = "article-events"
+	// 文章事件 stream 的近似最大长度
+	ArticleEventsMaxLen = 100000
+
+	// 每小时文章净得票有序集合前缀，完整 key 为 leaderboard:<整点时间戳>
+	LeaderboardPre = "leaderboard:"
+	// 滚动窗口排行榜缓存前缀，完整 key 为 leaderboard-window:<窗口名>
+	LeaderboardWindowPre = "leaderboard-window:"
+	// 最近 24 小时排行榜
+	LeaderboardDay = "day"
+	// 最近 7 天排行榜
+	LeaderboardWeek = "week"
+
+	// 文章投票来源计数哈希前缀，field 为 total、ip:<ip>、fp:<设备指纹>
+	VoteSourcesPre = "vote-sources:"
+	// 文章被隔离的投票哈希前缀，field 为用户，value 为投票 json
+	QuarantinedVotesPre = "quarantined-votes:"
+	// 被标记的文章有序集合，分值为待审核的投票数
+	FlaggedArticles = "flagged-articles"
+
+	// 用户投过赞成票的文章集合前缀
+	UserVotedPre = "user-voted:"
+	// 最近投票的用户有序集合，分值为最后投票时间
+	RecentVoters = "recent-voters"
+	// 用户推荐文章有序集合前缀，分值为相似度
+	RecommendationsPre = "recommendations:"
+
+	// 分组集合前缀
+	GroupPre = "group:"
+	// 文章所属分组集合前缀
+	ArticleGroupsPre = "article-groups:"
+	// 已归档文章哈希集合，field 为文章 id，value 为文章 json
+	ArticleArchive = "article-archive"
+	// 导入时写入数据的临时 key 前缀，写完后改名为目标 key
+	ImportStagingPre = "import-staging:"
+
+	// 每页文章数
+	ArticlesPerPage = 25
+	// 分组排序结果的缓存秒数
+	GroupCacheSeconds = 60
+	// 每次归档的最大文章数
+	ArchiveBatchSize = 100
+	// 重新计算排名的间隔秒数
+	RefreshRanksSeconds = 300
+	// 并发投票导致重新计算排名的事务失败时的最大重试次数
+	UpdateRanksRetries = 5
+	// 滚动窗口排行榜的缓存秒数
+	LeaderboardCacheSeconds = 60
+	// 同一 IP 或设备指纹的投票占比超过该值时隔离投票
+	VoteFraudShare = 0.5
+	// 文章的来源可追踪投票数达到该值后才检查占比
+	VoteFraudMinVotes = 5
+	// 计算推荐时最多取用户投过票的文章数
+	RecommendSeeds = 20
+	// 计算推荐时每篇文章最多抽样的投票用户数
+	RecommendSampleVoters = 50
+	// 计算推荐时最多计算相似度的候选文章数
+	RecommendCandidates = 200
+	// 每个用户保存的最大推荐数
+	RecommendMax = 100
+	// 没有可推荐文章时写入推荐结果的占位成员，分值为 0，避免每次读取都重新计算
+	RecommendNone = "none"
+	// 推荐结果的过期秒数
+	RecommendationSeconds = 60 * 60 * 24
+	// 刷新推荐的间隔秒数
+	RefreshRecommendationsSeconds = 600
 
 	// 一周的秒数
 	OneWeekInSeconds = 60 * 60 * 24 * 7
@@ -24,21 +120,60 @@ const (
 
 	// login 哈希集合
 	LoginHash = "login"
+	// 用户已签发 token 集合前缀
+	UserTokensPre = "user-tokens:"
+	// token 绑定的客户端哈希集合，field 为 token
+	LoginBinding = "login-binding"
+	// token 会话哈希前缀，field 为 user 和 binding，只在开启会话近端缓存时写入，
+	// 每个 token 一个 key，使登录和注销只让该 token 的近端缓存失效
+	SessionPre = "session:"
 
 	// 用户（token）最后访问时间的有序集合
 	Recent = "recent"
+	// 默认保留的最大会话数
+	SessionMax = 10000000
+	// 每批淘汰的最大会话数
+	SessionEvictBatch = 100
 
 	// 某个用户最近浏览商品的有序集合前缀
 	ViewedPre = "viewed:"
+	// 每个用户保留的最近浏览商品数
+	ViewedMax = 25
 
 	// 所有用户浏览的商品次数集合
 	Viewed = "viewed"
+	// 商品共同浏览有序集合前缀，成员为同一会话中一起浏览过的商品，分值为随时间衰减的共同浏览次数
+	CoViewedPre = "co-viewed:"
+	// 有共同浏览记录的商品集合
+	CoViewedItems = "co-viewed-items"
+	// 会话推荐结果的缓存前缀
+	CoViewedSessionPre = "co-viewed-session:"
+	// 每个商品保留的最大共同浏览商品数
+	CoViewedMax = 100
+	// 衰减后共同浏览分值低于该值的商品被移除
+	CoViewedMinScore = 0.01
+	// 会话推荐结果的缓存秒数
+	CoViewedSessionSeconds = 60
 
 	// 购物车前缀
 	CartPre = "cart:"
+	// 商品目录哈希集合，field 为商品，value 为以分为单位的价格
+	ProductCatalog = "product-catalog"
+	// 购物车每种商品的最大数量
+	CartMaxQuantity = 99
 
 	// 网页请求缓存前缀
 	ReqCachePre = "reqcache:"
+	// 网页请求重新生成时的锁前缀
+	ReqLockPre = "reqcache-lock:"
+	// 网页响应 Vary 请求头列表前缀
+	ReqVaryPre = "reqcache-vary:"
+	// 同一 URL 所有变体的网页缓存 key 集合前缀
+	ReqVariantsPre = "reqcache-variants:"
+	// 网页请求的默认缓存秒数
+	ReqCacheSeconds = 300
+	// 缓存的网页响应体最大字节数
+	ReqCacheMaxBody = 1 << 20
 
 	// schedule 有序集合
 	Schedule = "schedule"
@@ -46,6 +181,19 @@ const (
 	Delay = "delay"
 	// 数据行缓存前缀
 	RowCachePre = "row-req:"
+	// 每次刷新的最大数据行数
+	RowCacheBatch = 100
+	// 商品相关网页缓存 key 集合前缀，用于按商品失效网页缓存
+	ReqCacheItemPre = "reqcache-item:"
+
+	// 缓存失效消息频道
+	InvalidationChannel = "invalidation"
+	// 缓存失效消息日志 stream，用于订阅者补齐错过的消息
+	InvalidationLog = "invalidation-log"
+	// 缓存失效消息序号
+	InvalidationSeq = "invalidation-seq"
+	// 缓存失效消息日志的最大长度
+	InvalidationLogMaxLen = 10000
 
 	// 买卖市场商品的有序集合
 	Market = "Market"
@@ -58,4 +206,9 @@ const (
 	RecentLogListPre = "recent-log-list:"
 	// 日志出现频率有序集合前缀
 	FrequencyLogZSetPre = "frequency-log-zset:"
+
+	// common
+
+	// 限流 key 前缀
+	RateLimitPre = "rate-limit:"
 )
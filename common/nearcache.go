@@ -0,0 +1,406 @@
+package common
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// nearCacheMinVersion CLIENT TRACKING 需要的最低服务端版本
+	nearCacheMinVersion = "6.0.0"
+	// invalidateChannel 服务端发送失效消息的频道
+	invalidateChannel = "__redis__:invalidate"
+	// entryOverhead 每个缓存条目除 key 和 value 外的估算字节数
+	entryOverhead = 64
+	// defaultNearCacheBytes 未设置 MaxBytes 时的字节数上限
+	defaultNearCacheBytes = 64 << 20
+)
+
+// ErrNearCacheUnsupported 服务端版本不支持 CLIENT TRACKING
+var ErrNearCacheUnsupported = errors.New("near cache requires redis " + nearCacheMinVersion + " or later")
+
+// errNearCacheClosed 读取时近端缓存已被关闭，调用方改为直接读取 redis
+var errNearCacheClosed = errors.New("near cache closed")
+
+// NearCacheOptions 近端缓存配置
+type NearCacheOptions struct {
+	// MaxBytes 缓存条目估算占用的字节数上限，超过时淘汰最久未使用的条目，为 0 时使用 64MB
+	MaxBytes int64
+	// Prefixes 不为空时使用广播模式，服务端对这些前缀下所有 key 的修改发送失效消息；
+	// 为空时使用默认模式，服务端只对读过的 key 发送失效消息，但需要为读过的 key 保存状态
+	Prefixes []string
+}
+
+// NearCacheStats 近端缓存统计
+type NearCacheStats struct {
+	Hits          int64
+	Misses        int64
+	Evictions     int64
+	Invalidations int64
+	Entries       int
+	Bytes         int64
+}
+
+type nearEntry struct {
+	cacheKey string
+	redisKey string
+	value    string
+	size     int64
+}
+
+// NearCache 进程内的 LRU 近端缓存，借助 redis 服务端辅助的客户端缓存（CLIENT TRACKING）在数据被修改时失效。
+// 失效消息以 RESP2 的 REDIRECT 方式发送到独立的订阅连接，订阅连接重连后清空缓存并以新的连接 id 重新开启跟踪。
+// 不使用 RESP3 是因为当前的 go-redis 不处理推送消息，失效推送会被当作下一条命令的回复读取；
+// REDIRECT 同时兼容只支持 RESP2 的代理，代价是多占用一个连接，且订阅连接断开期间的失效需要靠清空缓存弥补
+type NearCache struct {
+	opts NearCacheOptions
+
+	// reader 开启了跟踪的读连接池，订阅连接重连后替换
+	reader atomic.Pointer[redis.Client]
+	sub    *redis.Client
+	subID  atomic.Int64
+	pubsub *redis.PubSub
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// closeMu 未命中时读取 redis 期间持有读锁，关闭读连接前持有写锁
+	closeMu sync.RWMutex
+	closed  bool
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	// byKey redis key 到其缓存条目的索引，失效消息以 redis key 为单位
+	byKey map[string]map[string]*list.Element
+	bytes int64
+	// epoch 清空缓存时递增，读取期间发生清空的结果不写入缓存
+	epoch uint64
+	// pending 正在从 redis 读取的 key 计数，dirty 为读取期间收到失效消息的 key
+	pending map[string]int
+	dirty   map[string]bool
+
+	hits, misses, evictions, invalidations atomic.Int64
+}
+
+func newNearCache(opts NearCacheOptions) *NearCache {
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = defaultNearCacheBytes
+	}
+	return &NearCache{
+		opts:    opts,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		byKey:   make(map[string]map[string]*list.Element),
+		pending: make(map[string]int),
+		dirty:   make(map[string]bool),
+	}
+}
+
+// EnableNearCache 开启近端缓存，之后 CachedGet 和 CachedHGet 优先读取进程内缓存，需要 redis 6.0 及以上，
+// opts 为 nil 时使用默认配置
+func (c *Client) EnableNearCache(ctx context.Context, opts *NearCacheOptions) error {
+	c.nearMu.Lock()
+	defer c.nearMu.Unlock()
+
+	if c.near.Load() != nil {
+		return errors.New("near cache already enabled")
+	}
+	if opts == nil {
+		opts = &NearCacheOptions{}
+	}
+	ver, err := serverVersion(ctx, c.Client)
+	if err != nil {
+		return err
+	}
+	if _, err := checkVersion(ver, nearCacheMinVersion); err != nil {
+		return ErrNearCacheUnsupported
+	}
+
+	nc := newNearCache(*opts)
+	subOpts := *c.Options()
+	subOpts.PoolSize = 1
+	subOpts.Protocol = 2
+	subOpts.OnConnect = func(ctx context.Context, cn *redis.Conn) error {
+		id, err := cn.ClientID(ctx).Result()
+		nc.subID.Store(id)
+		return err
+	}
+	nc.sub = redis.NewClient(&subOpts)
+	nc.pubsub = nc.sub.Subscribe(ctx, invalidateChannel)
+	if _, err := nc.pubsub.ReceiveTimeout(ctx, 5*time.Second); err != nil {
+		nc.sub.Close()
+		return err
+	}
+	if err := nc.track(ctx, c.Options()); err != nil {
+		nc.sub.Close()
+		return err
+	}
+
+	loopCtx, cancel := context.WithCancel(context.Background())
+	nc.cancel, nc.done = cancel, make(chan struct{})
+	go nc.listen(loopCtx, c.Options())
+
+	c.near.Store(nc)
+	return nil
+}
+
+// DisableNearCache 关闭近端缓存并释放其连接，正在进行的读取改为直接读取 redis
+func (c *Client) DisableNearCache() error {
+	c.nearMu.Lock()
+	defer c.nearMu.Unlock()
+
+	nc := c.near.Swap(nil)
+	if nc == nil {
+		return nil
+	}
+
+	nc.cancel()
+	nc.pubsub.Close()
+	<-nc.done
+
+	nc.closeMu.Lock()
+	nc.closed = true
+	nc.closeMu.Unlock()
+	nc.reader.Load().Close()
+	return nc.sub.Close()
+}
+
+// NearCache 返回近端缓存，未开启时为 nil
+func (c *Client) NearCache() *NearCache {
+	return c.near.Load()
+}
+
+// CachedGet 带近端缓存的 GET，未开启近端缓存时直接读取 redis
+func (c *Client) CachedGet(ctx context.Context, key string) (string, error) {
+	if nc := c.near.Load(); nc != nil {
+		value, err := nc.load(ctx, key, "g\x00"+key, func(reader *redis.Client) (string, error) {
+			return reader.Get(ctx, key).Result()
+		})
+		if err != errNearCacheClosed {
+			return value, err
+		}
+	}
+	return c.Get(ctx, key).Result()
+}
+
+// CachedHGet 带近端缓存的 HGET，哈希中任一 field 被修改都会使该哈希的所有缓存失效
+func (c *Client) CachedHGet(ctx context.Context, key, field string) (string, error) {
+	if nc := c.near.Load(); nc != nil {
+		value, err := nc.load(ctx, key, "h\x00"+key+"\x00"+field, func(reader *redis.Client) (string, error) {
+			return reader.HGet(ctx, key, field).Result()
+		})
+		if err != errNearCacheClosed {
+			return value, err
+		}
+	}
+	return c.HGet(ctx, key, field).Result()
+}
+
+// track 以当前订阅连接 id 创建开启跟踪的读连接，替换并稍后关闭旧的读连接。
+// 跟踪状态随连接断开而丢失，读连接只保留一个，重连时清空缓存
+func (nc *NearCache) track(ctx context.Context, base *redis.Options) error {
+	args := []any{"CLIENT", "TRACKING", "ON", "REDIRECT", nc.subID.Load()}
+	if len(nc.opts.Prefixes) != 0 {
+		args = append(args, "BCAST")
+		for _, prefix := range nc.opts.Prefixes {
+			args = append(args, "PREFIX", prefix)
+		}
+	}
+
+	readerOpts := *base
+	readerOpts.PoolSize = 1
+	connected := false
+	readerOpts.OnConnect = func(ctx context.Context, cn *redis.Conn) error {
+		if connected {
+			nc.Flush()
+		}
+		connected = true
+		return cn.Process(ctx, redis.NewStatusCmd(ctx, args...))
+	}
+	reader := redis.NewClient(&readerOpts)
+	if err := reader.Ping(ctx).Err(); err != nil {
+		reader.Close()
+		return err
+	}
+
+	if old := nc.reader.Swap(reader); old != nil {
+		// 等待正在进行的读取结束
+		time.AfterFunc(10*time.Second, func() { old.Close() })
+	}
+	return nil
+}
+
+// listen 处理失效消息直到 ctx 取消
+func (nc *NearCache) listen(ctx context.Context, base *redis.Options) {
+	defer close(nc.done)
+
+	for {
+		msg, err := nc.pubsub.Receive(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			// 连接断开或无法解析的消息（如 FLUSHALL 的空消息）都可能错过失效，清空缓存
+			logrus.Errorf("receive near cache invalidation failed, err: %v", err)
+			nc.Flush()
+			if SleepContext(ctx, 100*time.Millisecond) != nil {
+				return
+			}
+			continue
+		}
+
+		switch m := msg.(type) {
+		case *redis.Subscription:
+			// 订阅连接重连后 id 改变，需要以新的 id 重新开启跟踪
+			if m.Kind == "subscribe" {
+				nc.Flush()
+				if err := nc.track(ctx, base); err != nil {
+					logrus.Errorf("restart client tracking failed, err: %v", err)
+				}
+			}
+		case *redis.Message:
+			if m.PayloadSlice == nil && m.Payload == "" {
+				nc.Flush()
+				continue
+			}
+			keys := m.PayloadSlice
+			if keys == nil {
+				keys = []string{m.Payload}
+			}
+			for _, key := range keys {
+				nc.invalidate(key)
+			}
+		}
+	}
+}
+
+// load 读取缓存，未命中时通过开启跟踪的连接读取 redis 并写入缓存，redis.Nil 不缓存
+func (nc *NearCache) load(ctx context.Context, redisKey, cacheKey string, fetch func(*redis.Client) (string, error)) (string, error) {
+	nc.mu.Lock()
+	if elem, ok := nc.entries[cacheKey]; ok {
+		nc.lru.MoveToFront(elem)
+		value := elem.Value.(*nearEntry).value
+		nc.mu.Unlock()
+		nc.hits.Add(1)
+		return value, nil
+	}
+	epoch := nc.epoch
+	nc.pending[redisKey]++
+	nc.mu.Unlock()
+	nc.misses.Add(1)
+
+	var value string
+	var err error
+	nc.closeMu.RLock()
+	if nc.closed {
+		nc.closeMu.RUnlock()
+		value, err = "", errNearCacheClosed
+	} else {
+		value, err = fetch(nc.reader.Load())
+		nc.closeMu.RUnlock()
+	}
+
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	dirty := nc.dirty[redisKey]
+	if nc.pending[redisKey]--; nc.pending[redisKey] == 0 {
+		delete(nc.pending, redisKey)
+		delete(nc.dirty, redisKey)
+	}
+	if err == nil && !dirty && epoch == nc.epoch {
+		nc.put(redisKey, cacheKey, value)
+	}
+	return value, err
+}
+
+// put 写入缓存条目并按 MaxBytes 淘汰，调用方需持有锁
+func (nc *NearCache) put(redisKey, cacheKey, value string) {
+	size := int64(len(cacheKey)+len(value)) + entryOverhead
+	if size > nc.opts.MaxBytes {
+		return
+	}
+	if elem, ok := nc.entries[cacheKey]; ok {
+		nc.remove(elem)
+	}
+
+	elem := nc.lru.PushFront(&nearEntry{cacheKey: cacheKey, redisKey: redisKey, value: value, size: size})
+	nc.entries[cacheKey] = elem
+	if nc.byKey[redisKey] == nil {
+		nc.byKey[redisKey] = make(map[string]*list.Element)
+	}
+	nc.byKey[redisKey][cacheKey] = elem
+	nc.bytes += size
+
+	for nc.bytes > nc.opts.MaxBytes {
+		nc.remove(nc.lru.Back())
+		nc.evictions.Add(1)
+	}
+}
+
+// remove 删除缓存条目，调用方需持有锁
+func (nc *NearCache) remove(elem *list.Element) {
+	entry := nc.lru.Remove(elem).(*nearEntry)
+	delete(nc.entries, entry.cacheKey)
+	if keys := nc.byKey[entry.redisKey]; keys != nil {
+		delete(keys, entry.cacheKey)
+		if len(keys) == 0 {
+			delete(nc.byKey, entry.redisKey)
+		}
+	}
+	nc.bytes -= entry.size
+}
+
+// invalidate 删除 redis key 的所有缓存条目
+func (nc *NearCache) invalidate(redisKey string) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	nc.invalidations.Add(1)
+	if nc.pending[redisKey] > 0 {
+		nc.dirty[redisKey] = true
+	}
+	for _, elem := range nc.byKey[redisKey] {
+		nc.remove(elem)
+	}
+}
+
+// Flush 清空缓存
+func (nc *NearCache) Flush() {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	nc.epoch++
+	nc.lru.Init()
+	nc.entries = make(map[string]*list.Element)
+	nc.byKey = make(map[string]map[string]*list.Element)
+	nc.bytes = 0
+}
+
+// Stats 返回缓存统计
+func (nc *NearCache) Stats() NearCacheStats {
+	nc.mu.Lock()
+	entries, bytes := len(nc.entries), nc.bytes
+	nc.mu.Unlock()
+
+	return NearCacheStats{
+		Hits:          nc.hits.Load(),
+		Misses:        nc.misses.Load(),
+		Evictions:     nc.evictions.Load(),
+		Invalidations: nc.invalidations.Load(),
+		Entries:       entries,
+		Bytes:         bytes,
+	}
+}
+
+func (s NearCacheStats) String() string {
+	return fmt.Sprintf("hits=%d misses=%d evictions=%d invalidations=%d entries=%d bytes=%d",
+		s.Hits, s.Misses, s.Evictions, s.Invalidations, s.Entries, s.Bytes)
+}
@@ -0,0 +1,104 @@
+package common
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNearCacheLRU(t *testing.T) {
+	ctx := context.Background()
+	nc := newNearCache(NearCacheOptions{MaxBytes: 3 * (entryOverhead + 5)})
+
+	fetch := func(value string) func(*redis.Client) (string, error) {
+		return func(*redis.Client) (string, error) { return value, nil }
+	}
+
+	for _, key := range []string{"a", "b", "c"} {
+		v, err := nc.load(ctx, key, "g:"+key, fetch(key+"v"))
+		assert.Nil(t, err)
+		assert.Equal(t, key+"v", v)
+	}
+	v, _ := nc.load(ctx, "a", "g:a", fetch("stale"))
+	assert.Equal(t, "av", v, "cached value should be served")
+
+	// 超出上限时淘汰最久未使用的 b
+	nc.load(ctx, "d", "g:d", fetch("dv"))
+	stats := nc.Stats()
+	assert.Equal(t, int64(1), stats.Hits)
+	assert.Equal(t, int64(4), stats.Misses)
+	assert.Equal(t, int64(1), stats.Evictions)
+	assert.Equal(t, 3, stats.Entries)
+	assert.LessOrEqual(t, stats.Bytes, nc.opts.MaxBytes)
+	v, _ = nc.load(ctx, "b", "g:b", fetch("bv2"))
+	assert.Equal(t, "bv2", v)
+
+	// 失效消息删除 redis key 的所有条目
+	nc.invalidate("b")
+	v, _ = nc.load(ctx, "b", "g:b", fetch("bv3"))
+	assert.Equal(t, "bv3", v)
+	assert.Equal(t, int64(1), nc.Stats().Invalidations)
+
+	// 读取期间收到失效消息时不缓存读到的旧值
+	nc.load(ctx, "e", "g:e", func(*redis.Client) (string, error) {
+		nc.invalidate("e")
+		return "old", nil
+	})
+	v, _ = nc.load(ctx, "e", "g:e", fetch("new"))
+	assert.Equal(t, "new", v)
+
+	// 不缓存 redis.Nil
+	_, err := nc.load(ctx, "f", "g:f", func(*redis.Client) (string, error) { return "", redis.Nil })
+	assert.Equal(t, redis.Nil, err)
+	_, err = nc.load(ctx, "f", "g:f", func(*redis.Client) (string, error) { return "", redis.Nil })
+	assert.Equal(t, redis.Nil, err)
+
+	nc.Flush()
+	assert.Equal(t, 0, nc.Stats().Entries)
+	assert.Equal(t, int64(0), nc.Stats().Bytes)
+
+	// 关闭后的读取交由调用方直接读取 redis
+	nc.closed = true
+	_, err = nc.load(ctx, "g", "g:g", fetch("gv"))
+	assert.Equal(t, errNearCacheClosed, err)
+}
+
+func TestNearCache(t *testing.T) {
+	ctx := context.Background()
+	conn := connectTestRedis(t)
+	defer conn.Close()
+
+	for _, opts := range []*NearCacheOptions{nil, {Prefixes: []string{"near:"}}} {
+		client := NewClient(conn)
+		err := client.EnableNearCache(ctx, opts)
+		if err == ErrNearCacheUnsupported {
+			t.Skip(err)
+		}
+		assert.Nil(t, err)
+
+		client.Set(ctx, "near:key", "v1", 0)
+		client.HSet(ctx, "near:hash", "field", "h1")
+		v, _ := client.CachedGet(ctx, "near:key")
+		assert.Equal(t, "v1", v)
+		v, _ = client.CachedGet(ctx, "near:key")
+		assert.Equal(t, "v1", v)
+		v, _ = client.CachedHGet(ctx, "near:hash", "field")
+		assert.Equal(t, "h1", v)
+		assert.Equal(t, int64(1), client.NearCache().Stats().Hits)
+
+		// 其他连接修改后失效
+		conn.Set(ctx, "near:key", "v2", 0)
+		conn.HSet(ctx, "near:hash", "field", "h2")
+		assert.Eventually(t, func() bool {
+			v, _ := client.CachedGet(ctx, "near:key")
+			h, _ := client.CachedHGet(ctx, "near:hash", "field")
+			return v == "v2" && h == "h2"
+		}, time.Second, 10*time.Millisecond)
+
+		conn.Del(ctx, "near:key", "near:hash")
+		assert.Nil(t, client.DisableNearCache())
+	}
+}
@@ -0,0 +1,195 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrRateLimited 请求被限流，具体的重试时间见 RateLimitError
+var ErrRateLimited = errors.New("rate limited")
+
+// RateLimitError 请求被限流的错误，RetryAfter 为建议的重试等待时间
+type RateLimitError struct {
+	Key        string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limited on %s, retry after %v", e.Key, e.RetryAfter)
+}
+
+// Is 使 errors.Is(err, ErrRateLimited) 成立
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+// RateLimitResult 一次限流检查的结果
+type RateLimitResult struct {
+	Allowed    bool
+	Remaining  int64
+	RetryAfter time.Duration
+}
+
+// RateLimiter 基于 redis 的分布式限流器，key 标识被限流的对象，如 post:<user>
+type RateLimiter interface {
+	Allow(ctx context.Context, key string) (*RateLimitResult, error)
+}
+
+// CheckRateLimit 检查限流，被限流时返回 *RateLimitError，limiter 为 nil 时不限流
+func CheckRateLimit(ctx context.Context, limiter RateLimiter, key string) error {
+	if limiter == nil {
+		return nil
+	}
+	res, err := limiter.Allow(ctx, key)
+	if err != nil {
+		return err
+	}
+	if !res.Allowed {
+		return &RateLimitError{Key: key, RetryAfter: res.RetryAfter}
+	}
+	return nil
+}
+
+// fixedWindowScript 固定窗口计数
+//
+// KEYS: 计数 key
+// ARGV: 窗口毫秒数
+// 返回: {当前计数, 窗口剩余毫秒数}
+var fixedWindowScript = redis.NewScript(`
+local n = redis.call('INCR', KEYS[1])
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl < 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+	ttl = tonumber(ARGV[1])
+end
+return {n, ttl}
+`)
+
+// FixedWindowLimiter 固定窗口限流，每个窗口内最多 Limit 次
+type FixedWindowLimiter struct {
+	client *Client
+	Limit  int64
+	Window time.Duration
+}
+
+func NewFixedWindowLimiter(client *Client, limit int64, window time.Duration) *FixedWindowLimiter {
+	return &FixedWindowLimiter{client: client, Limit: limit, Window: window}
+}
+
+func (l *FixedWindowLimiter) Allow(ctx context.Context, key string) (*RateLimitResult, error) {
+	res, err := fixedWindowScript.Run(ctx, l.client, []string{RateLimitPre + "fixed:" + key},
+		l.Window.Milliseconds()).Int64Slice()
+	if err != nil {
+		return nil, err
+	}
+
+	n, ttl := res[0], res[1]
+	if n > l.Limit {
+		return &RateLimitResult{RetryAfter: time.Duration(ttl) * time.Millisecond}, nil
+	}
+	return &RateLimitResult{Allowed: true, Remaining: l.Limit - n}, nil
+}
+
+// slidingWindowScript 滑动窗口日志，有序集合中记录窗口内每次请求的时间
+//
+// KEYS: 日志 key
+// ARGV: 当前毫秒时间, 窗口毫秒数, 上限, 本次请求的成员
+// 返回: {是否允许, 剩余次数, 重试等待毫秒数}
+var slidingWindowScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local n = redis.call('ZCARD', KEYS[1])
+if n < limit then
+	redis.call('ZADD', KEYS[1], now, ARGV[4])
+	redis.call('PEXPIRE', KEYS[1], window)
+	return {1, limit - n - 1, 0}
+end
+local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+return {0, 0, tonumber(oldest[2]) + window - now}
+`)
+
+// SlidingWindowLimiter 滑动窗口日志限流，任意 Window 时长内最多 Limit 次
+type SlidingWindowLimiter struct {
+	client *Client
+	Limit  int64
+	Window time.Duration
+}
+
+func NewSlidingWindowLimiter(client *Client, limit int64, window time.Duration) *SlidingWindowLimiter {
+	return &SlidingWindowLimiter{client: client, Limit: limit, Window: window}
+}
+
+func (l *SlidingWindowLimiter) Allow(ctx context.Context, key string) (*RateLimitResult, error) {
+	now := time.Now().UnixMilli()
+	member := strconv.FormatInt(now, 10) + "-" + strconv.FormatInt(rand.Int63(), 36)
+
+	res, err := slidingWindowScript.Run(ctx, l.client, []string{RateLimitPre + "sliding:" + key},
+		now, l.Window.Milliseconds(), l.Limit, member).Int64Slice()
+	if err != nil {
+		return nil, err
+	}
+
+	return &RateLimitResult{
+		Allowed:    res[0] == 1,
+		Remaining:  res[1],
+		RetryAfter: time.Duration(res[2]) * time.Millisecond,
+	}, nil
+}
+
+// tokenBucketScript 令牌桶，哈希中记录剩余令牌数和上次补充时间
+//
+// KEYS: 令牌桶 key
+// ARGV: 每毫秒补充的令牌数, 桶容量, 当前毫秒时间
+// 返回: {是否允许, 剩余令牌数, 重试等待毫秒数}
+var tokenBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1]) or burst
+local ts = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+local allowed, retry = 0, 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	retry = math.ceil((1 - tokens) / rate)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate))
+return {allowed, math.floor(tokens), retry}
+`)
+
+// TokenBucketLimiter 令牌桶限流，每秒补充 Rate 个令牌，最多积攒 Burst 个
+type TokenBucketLimiter struct {
+	client *Client
+	Rate   float64
+	Burst  int64
+}
+
+func NewTokenBucketLimiter(client *Client, rate float64, burst int64) *TokenBucketLimiter {
+	return &TokenBucketLimiter{client: client, Rate: rate, Burst: burst}
+}
+
+func (l *TokenBucketLimiter) Allow(ctx context.Context, key string) (*RateLimitResult, error) {
+	res, err := tokenBucketScript.Run(ctx, l.client, []string{RateLimitPre + "bucket:" + key},
+		strconv.FormatFloat(l.Rate/1000, 'g', -1, 64), l.Burst, time.Now().UnixMilli()).Int64Slice()
+	if err != nil {
+		return nil, err
+	}
+
+	return &RateLimitResult{
+		Allowed:    res[0] == 1,
+		Remaining:  res[1],
+		RetryAfter: time.Duration(res[2]) * time.Millisecond,
+	}, nil
+}
@@ -0,0 +1,35 @@
+package common
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiters(t *testing.T) {
+	ctx := context.Background()
+	client := NewClient(connectTestRedis(t))
+	defer client.Close()
+
+	limiters := map[string]RateLimiter{
+		"fixed":   NewFixedWindowLimiter(client, 2, time.Minute),
+		"sliding": NewSlidingWindowLimiter(client, 2, time.Minute),
+		"bucket":  NewTokenBucketLimiter(client, 0.01, 2),
+	}
+	for name, limiter := range limiters {
+		key := "test:" + name
+		defer client.Del(ctx, RateLimitPre+"fixed:"+key, RateLimitPre+"sliding:"+key, RateLimitPre+"bucket:"+key)
+
+		assert.Nil(t, CheckRateLimit(ctx, limiter, key), name)
+		assert.Nil(t, CheckRateLimit(ctx, limiter, key), name)
+
+		err := CheckRateLimit(ctx, limiter, key)
+		assert.ErrorIs(t, err, ErrRateLimited, name)
+		var limited *RateLimitError
+		if assert.ErrorAs(t, err, &limited, name) {
+			assert.Greater(t, limited.RetryAfter, time.Duration(0), name)
+		}
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
+	"sync"
+	"sync/atomic"
 
 	goversion "github.com/hashicorp/go-version"
 	"github.com/redis/go-redis/v9"
@@ -23,10 +25,15 @@ type RedisConf struct {
 
 type Client struct {
 	*redis.Client
+
+	// near 近端缓存，EnableNearCache 后才不为 nil，可与 CachedGet 等读取并发修改
+	near atomic.Pointer[NearCache]
+	// nearMu 串行化 EnableNearCache 和 DisableNearCache
+	nearMu sync.Mutex
 }
 
 func NewClient(c *redis.Client) *Client {
-	return &Client{c}
+	return &Client{Client: c}
 }
 
 func ConnectRedis(ctx context.Context, conf *RedisConf) *redis.Client {
@@ -54,6 +61,16 @@ func ConnectRedis(ctx context.Context, conf *RedisConf) *redis.Client {
 }
 
 func checkServerVersion(ctx context.Context, conn *redis.Client) (string, error) {
+	ver, err := serverVersion(ctx, conn)
+	if err != nil {
+		return "", err
+	}
+
+	return checkVersion(ver, REDIS_MIN_VERSION)
+}
+
+// serverVersion 返回 redis 服务端版本
+func serverVersion(ctx context.Context, conn *redis.Client) (string, error) {
 	cmd := conn.Info(ctx, "server")
 
 	serverInfo := cmd.Val()
@@ -68,9 +85,7 @@ func checkServerVersion(ctx context.Context, conn *redis.Client) (string, error)
 	if len(matchSlice) < 2 {
 		return "", errors.New("Regexp not match redis_version")
 	}
-	ver := matchSlice[1]
-
-	return checkVersion(ver, REDIS_MIN_VERSION)
+	return matchSlice[1], nil
 }
 
 func checkVersion(serverVer, minVer string) (string, error) {
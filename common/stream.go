@@ -0,0 +1,192 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+// StreamConsumer 基于消费者组的 stream 消费者，支持确认、领取超时未确认的消息和从指定 id 重放，
+// 不能在多个 goroutine 中并发使用同一个 StreamConsumer
+type StreamConsumer struct {
+	client   *Client
+	Stream   string
+	Group    string
+	Consumer string
+	// Count 每次读取的最大消息数
+	Count int64
+	// Block 没有新消息时阻塞等待的时间
+	Block time.Duration
+	// MinIdle 其他消费者读取后超过该时间仍未确认的消息会被领取
+	MinIdle time.Duration
+
+	// reclaimStart Reclaim 下一页待确认列表的起始 id，为空时从头开始
+	reclaimStart string
+}
+
+func NewStreamConsumer(client *Client, stream, group, consumer string) *StreamConsumer {
+	return &StreamConsumer{
+		client:   client,
+		Stream:   stream,
+		Group:    group,
+		Consumer: consumer,
+		Count:    100,
+		Block:    5 * time.Second,
+		MinIdle:  time.Minute,
+	}
+}
+
+// EnsureGroup 创建消费者组，stream 不存在时一并创建，startID 为 "$" 时只消费之后的新消息，"0" 时消费全部历史
+func (c *StreamConsumer) EnsureGroup(ctx context.Context, startID string) error {
+	err := c.client.XGroupCreateMkStream(ctx, c.Stream, c.Group, startID).Err()
+	if err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil
+	}
+	return err
+}
+
+// Read 读取分配给本消费者的新消息，超时没有消息时返回空
+func (c *StreamConsumer) Read(ctx context.Context) ([]redis.XMessage, error) {
+	streams, err := c.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    c.Group,
+		Consumer: c.Consumer,
+		Streams:  []string{c.Stream, ">"},
+		Count:    c.Count,
+		Block:    c.Block,
+	}).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return streams[0].Messages, nil
+}
+
+// Ack 确认消息已处理
+func (c *StreamConsumer) Ack(ctx context.Context, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return c.client.XAck(ctx, c.Stream, c.Group, ids...).Err()
+}
+
+// Reclaim 将其他消费者超过 MinIdle 仍未确认的消息转移给本消费者并返回，
+// 每次调用只检查待确认列表的一页（至多 Count 条），下次调用从这一页之后继续，到达末尾后从头开始
+func (c *StreamConsumer) Reclaim(ctx context.Context) ([]redis.XMessage, error) {
+	// XPENDING 的 IDLE 参数和 XAUTOCLAIM 需要 6.2，这里分页读取待确认列表并在客户端过滤以兼容 REDIS_MIN_VERSION
+	start := c.reclaimStart
+	if start == "" {
+		start = "-"
+	}
+	pending, err := c.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: c.Stream,
+		Group:  c.Group,
+		Start:  start,
+		End:    "+",
+		Count:  c.Count,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	c.reclaimStart = ""
+	if int64(len(pending)) == c.Count {
+		if c.reclaimStart, err = nextStreamID(pending[len(pending)-1].ID); err != nil {
+			return nil, err
+		}
+	}
+
+	ids := make([]string, 0, len(pending))
+	for _, p := range pending {
+		if p.Idle >= c.MinIdle {
+			ids = append(ids, p.ID)
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	return c.client.XClaim(ctx, &redis.XClaimArgs{
+		Stream:   c.Stream,
+		Group:    c.Group,
+		Consumer: c.Consumer,
+		MinIdle:  c.MinIdle,
+		Messages: ids,
+	}).Result()
+}
+
+// nextStreamID 返回紧接在 id 之后的消息 id，用于代替 6.2 才支持的开区间 "(id"
+func nextStreamID(id string) (string, error) {
+	ms, seq, ok := strings.Cut(id, "-")
+	if !ok {
+		return "", fmt.Errorf("invalid stream id %q", id)
+	}
+	n, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid stream id %q", id)
+	}
+	return ms + "-" + strconv.FormatUint(n+1, 10), nil
+}
+
+// Replay 读取 id 大于 fromID 的至多 count 条历史消息，不影响消费者组的进度
+func (c *StreamConsumer) Replay(ctx context.Context, fromID string, count int64) ([]redis.XMessage, error) {
+	// 开区间 "(id" 需要 6.2，这里多读一条并跳过 fromID 本身
+	messages, err := c.client.XRangeN(ctx, c.Stream, fromID, "+", count+1).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) > 0 && messages[0].ID == fromID {
+		messages = messages[1:]
+	}
+	if int64(len(messages)) > count {
+		messages = messages[:count]
+	}
+	return messages, nil
+}
+
+// Rewind 将消费者组的进度重置到 id，之后 Read 会从 id 之后的消息重新投递
+func (c *StreamConsumer) Rewind(ctx context.Context, id string) error {
+	return c.client.XGroupSetID(ctx, c.Stream, c.Group, id).Err()
+}
+
+// Consume 持续消费直到 ctx 取消：先领取超时未确认的消息，再读取新消息，
+// handler 返回 nil 的消息会被确认，返回错误的消息留待之后重新领取
+func (c *StreamConsumer) Consume(ctx context.Context, handler func(redis.XMessage) error) error {
+	for ctx.Err() == nil {
+		messages, err := c.Reclaim(ctx)
+		if err != nil {
+			logrus.Errorf("reclaim stream %s pending messages failed, err: %v", c.Stream, err)
+		}
+
+		fresh, err := c.Read(ctx)
+		if err != nil && ctx.Err() == nil {
+			// 读取失败时仍处理已领取的消息，稍后重试
+			logrus.Errorf("read stream %s failed, err: %v", c.Stream, err)
+			if err := SleepContext(ctx, time.Second); err != nil {
+				// 已领取的消息未确认，之后会被重新领取
+				return err
+			}
+		}
+		messages = append(messages, fresh...)
+
+		acked := make([]string, 0, len(messages))
+		for _, msg := range messages {
+			if err := handler(msg); err != nil {
+				logrus.Errorf("handle stream %s message %s failed, err: %v", c.Stream, msg.ID, err)
+				continue
+			}
+			acked = append(acked, msg.ID)
+		}
+		if err := c.Ack(ctx, acked...); err != nil {
+			logrus.Errorf("ack stream %s messages failed, err: %v", c.Stream, err)
+		}
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,16 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNextStreamID(t *testing.T) {
+	id, err := nextStreamID("1526919030474-55")
+	assert.Nil(t, err)
+	assert.Equal(t, "1526919030474-56", id)
+
+	_, err = nextStreamID("1526919030474")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,207 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Job 后台任务，应在 ctx 取消后尽快返回；返回错误或 panic 视为崩溃，会在退避后重启
+type Job func(ctx context.Context) error
+
+// JobState 后台任务状态
+type JobState string
+
+const (
+	JobRunning  JobState = "running"
+	JobBackoff  JobState = "backoff"
+	JobFinished JobState = "finished"
+	JobStopped  JobState = "stopped"
+)
+
+// JobStatus 后台任务的运行状态
+type JobStatus struct {
+	Name      string
+	State     JobState
+	Restarts  int
+	LastError string
+	StartedAt time.Time
+}
+
+const (
+	// defaultMinBackoff 默认首次重启前的等待时间
+	defaultMinBackoff = time.Second
+	// defaultMaxBackoff 默认重启等待时间的上限
+	defaultMaxBackoff = time.Minute
+)
+
+// Supervisor 管理具名后台任务：ctx 取消时停止所有任务，崩溃的任务按指数退避重启
+type Supervisor struct {
+	// MinBackoff 首次重启前的等待时间，不大于 0 时使用 1 秒
+	MinBackoff time.Duration
+	// MaxBackoff 重启等待时间的上限，任务连续运行超过该时间后退避重置，小于 MinBackoff 时使用 MinBackoff，不大于 0 时使用 1 分钟
+	MaxBackoff time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu   sync.Mutex
+	jobs map[string]*JobStatus
+}
+
+func NewSupervisor(ctx context.Context) *Supervisor {
+	ctx, cancel := context.WithCancel(ctx)
+	return &Supervisor{
+		MinBackoff: defaultMinBackoff,
+		MaxBackoff: defaultMaxBackoff,
+		ctx:        ctx,
+		cancel:     cancel,
+		jobs:       make(map[string]*JobStatus),
+	}
+}
+
+// Go 启动具名后台任务，同名任务只能启动一次
+func (s *Supervisor) Go(name string, job Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.jobs[name]; ok {
+		return fmt.Errorf("job %s already exists", name)
+	}
+	if s.ctx.Err() != nil {
+		return errors.New("supervisor is shut down")
+	}
+	s.jobs[name] = &JobStatus{Name: name, State: JobRunning}
+
+	s.wg.Add(1)
+	go s.run(name, job)
+	return nil
+}
+
+func (s *Supervisor) run(name string, job Job) {
+	defer s.wg.Done()
+
+	minBackoff, maxBackoff := s.backoffRange()
+	backoff := minBackoff
+	for {
+		started := time.Now()
+		s.update(name, func(st *JobStatus) {
+			st.State, st.StartedAt = JobRunning, started
+		})
+
+		err := runJob(s.ctx, job)
+		if s.ctx.Err() != nil {
+			s.update(name, func(st *JobStatus) { st.State = JobStopped })
+			return
+		}
+		if err == nil {
+			s.update(name, func(st *JobStatus) { st.State = JobFinished })
+			return
+		}
+
+		// 运行足够久后再崩溃的任务重新从最小退避开始
+		if time.Since(started) > maxBackoff {
+			backoff = minBackoff
+		}
+		logrus.Errorf("job %s crashed, restart in %v, err: %v", name, backoff, err)
+		s.update(name, func(st *JobStatus) {
+			st.State, st.LastError = JobBackoff, err.Error()
+			st.Restarts++
+		})
+
+		if SleepContext(s.ctx, backoff) != nil {
+			s.update(name, func(st *JobStatus) { st.State = JobStopped })
+			return
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// backoffRange 返回修正后的退避范围，避免退避为 0 时崩溃的任务不停重启
+func (s *Supervisor) backoffRange() (time.Duration, time.Duration) {
+	minBackoff, maxBackoff := s.MinBackoff, s.MaxBackoff
+	if minBackoff <= 0 {
+		minBackoff = defaultMinBackoff
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = defaultMaxBackoff
+	}
+	if maxBackoff < minBackoff {
+		maxBackoff = minBackoff
+	}
+	return minBackoff, maxBackoff
+}
+
+// runJob 运行任务并将 panic 转为错误
+func runJob(ctx context.Context, job Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return job(ctx)
+}
+
+func (s *Supervisor) update(name string, fn func(*JobStatus)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(s.jobs[name])
+}
+
+// Status 返回按名称排序的所有任务状态
+func (s *Supervisor) Status() []JobStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := make([]JobStatus, 0, len(s.jobs))
+	for _, st := range s.jobs {
+		statuses = append(statuses, *st)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// Shutdown 取消所有任务并至多等待 timeout，超时时返回仍未退出的任务
+func (s *Supervisor) Shutdown(timeout time.Duration) error {
+	s.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		var running []string
+		for _, st := range s.Status() {
+			if st.State != JobStopped && st.State != JobFinished {
+				running = append(running, st.Name)
+			}
+		}
+		return fmt.Errorf("jobs not stopped after %v: %s", timeout, strings.Join(running, ", "))
+	}
+}
+
+// SleepContext 休眠 d，ctx 提前取消时返回 ctx.Err()
+func SleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
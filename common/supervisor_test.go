@@ -0,0 +1,73 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSupervisor(t *testing.T) {
+	s := NewSupervisor(context.Background())
+	s.MinBackoff = time.Millisecond
+	s.MaxBackoff = 10 * time.Millisecond
+
+	var runs int32
+	assert.NoError(t, s.Go("crash", func(ctx context.Context) error {
+		// 前两次崩溃，之后正常运行直到被取消
+		switch atomic.AddInt32(&runs, 1) {
+		case 1:
+			return errors.New("boom")
+		case 2:
+			panic("boom")
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	}))
+	assert.NoError(t, s.Go("once", func(ctx context.Context) error { return nil }))
+	assert.Error(t, s.Go("once", func(ctx context.Context) error { return nil }))
+
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&runs) == 3 }, time.Second, time.Millisecond)
+	assert.Eventually(t, func() bool {
+		statuses := s.Status()
+		return statuses[0].State == JobRunning && statuses[1].State == JobFinished
+	}, time.Second, time.Millisecond)
+
+	statuses := s.Status()
+	assert.Equal(t, "crash", statuses[0].Name)
+	assert.Equal(t, 2, statuses[0].Restarts)
+	assert.Equal(t, "panic: boom", statuses[0].LastError)
+
+	assert.NoError(t, s.Shutdown(time.Second))
+	assert.Equal(t, JobStopped, s.Status()[0].State)
+	assert.Error(t, s.Go("late", func(ctx context.Context) error { return nil }))
+}
+
+func TestSupervisorBackoffRange(t *testing.T) {
+	s := &Supervisor{}
+	minBackoff, maxBackoff := s.backoffRange()
+	assert.Equal(t, time.Second, minBackoff)
+	assert.Equal(t, time.Minute, maxBackoff)
+
+	s.MinBackoff, s.MaxBackoff = time.Hour, time.Millisecond
+	minBackoff, maxBackoff = s.backoffRange()
+	assert.Equal(t, time.Hour, minBackoff)
+	assert.Equal(t, time.Hour, maxBackoff)
+}
+
+func TestSupervisorShutdownTimeout(t *testing.T) {
+	s := NewSupervisor(context.Background())
+
+	release := make(chan struct{})
+	defer close(release)
+	assert.NoError(t, s.Go("stuck", func(ctx context.Context) error {
+		<-release
+		return nil
+	}))
+
+	err := s.Shutdown(10 * time.Millisecond)
+	assert.ErrorContains(t, err, "stuck")
+}